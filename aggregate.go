@@ -0,0 +1,314 @@
+package mongoq
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MatchStage converts expr into a $match aggregation stage using the default parser.
+func MatchStage(expr string) (bson.D, error) {
+	return defaultParser.MatchStage(expr)
+}
+
+// ParseExpr converts expr into an aggregation expression using the default parser.
+func ParseExpr(expr string) (bson.D, error) {
+	return defaultParser.ParseExpr(expr)
+}
+
+// MatchStage converts expr into a $match stage, including the parser's scope.
+func (p *Parser) MatchStage(expr string) (bson.D, error) {
+	filter, err := p.ParseD(expr)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: "$match", Value: filter}}, nil
+}
+
+// ParseExpr converts expr into an aggregation expression that evaluates to true or false, for use with $expr, $cond,
+// $project or $addFields.  Unlike a filter, an aggregation expression does not traverse arrays: name == x compares the
+// whole field with x.  Comparisons also follow the BSON type order instead of only matching values of the same type.
+// search() is not supported, and the scope is not applied since an expression does not select documents.
+func (p *Parser) ParseExpr(expr string) (bson.D, error) {
+	return p.ParseExprVar(expr, "")
+}
+
+// ParseExprVar is like ParseExpr, but fields are read from variable, e.g. "this" in a $filter, instead of the current
+// document.
+func (p *Parser) ParseExprVar(expr string, variable string) (bson.D, error) {
+	filter, err := p.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	prefix := "$"
+	if variable != "" {
+		prefix = "$$" + variable + "."
+	}
+	agg, err := aggFilter(filter, prefix)
+	if err != nil {
+		return nil, p.fail(expr, newParseError(CodeInvalidExpression, 0, len(expr), "", "%s", err.Error()))
+	}
+	return agg, nil
+}
+
+// aggFilter translates a filter into an aggregation expression; prefix turns a field path into a reference.
+func aggFilter(filter bson.D, prefix string) (bson.D, error) {
+	var terms []any
+	for _, e := range filter {
+		var term bson.D
+		var err error
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			term, err = aggLogical(e.Key, e.Value, prefix)
+		case "$expr":
+			if _, _, _, ok := exprComparison(e.Value); !ok {
+				return nil, fmt.Errorf("unsupported $expr")
+			}
+			term = aggFieldPaths(e.Value, prefix).(bson.D)
+		case "$not":
+			sub, ok := e.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$not needs a document")
+			}
+			if term, err = aggFilter(sub, prefix); err == nil {
+				term = bson.D{{Key: "$not", Value: []any{term}}}
+			}
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return nil, fmt.Errorf("%s is not supported in aggregation expressions", e.Key)
+			}
+			term, err = aggField(prefix+e.Key, e.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	switch len(terms) {
+	case 0:
+		return nil, fmt.Errorf("empty filter")
+	case 1:
+		return terms[0].(bson.D), nil
+	}
+	return bson.D{{Key: "$and", Value: terms}}, nil
+}
+
+func aggLogical(op string, value any, prefix string) (bson.D, error) {
+	subs, ok := value.([]any)
+	if !ok || len(subs) == 0 {
+		return nil, fmt.Errorf("%s needs a non-empty array", op)
+	}
+	terms := make([]any, 0, len(subs))
+	for _, sub := range subs {
+		d, ok := sub.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("%s entries must be documents", op)
+		}
+		term, err := aggFilter(d, prefix)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if op == "$nor" {
+		return bson.D{{Key: "$not", Value: []any{bson.D{{Key: "$or", Value: terms}}}}}, nil
+	}
+	return bson.D{{Key: op, Value: terms}}, nil
+}
+
+func aggField(ref string, cond any) (bson.D, error) {
+	ops, isOps := cond.(bson.D)
+	if isOps {
+		for _, e := range ops {
+			if !strings.HasPrefix(e.Key, "$") {
+				isOps = false
+				break
+			}
+		}
+	}
+	if !isOps {
+		return aggEquals(ref, cond), nil
+	}
+
+	var terms []any
+	for _, e := range ops {
+		var term bson.D
+		switch e.Key {
+		case "$eq":
+			term = aggEquals(ref, e.Value)
+		case "$ne":
+			term = bson.D{{Key: "$not", Value: []any{aggEquals(ref, e.Value)}}}
+		case "$gt", "$gte", "$lt", "$lte":
+			term = bson.D{{Key: e.Key, Value: []any{ref, aggLiteral(e.Value)}}}
+		case "$in", "$nin":
+			list, ok := e.Value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s needs an array", e.Key)
+			}
+			term = aggIn(ref, list)
+			if e.Key == "$nin" {
+				term = bson.D{{Key: "$not", Value: []any{term}}}
+			}
+		case "$all":
+			list, ok := e.Value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("$all needs an array")
+			}
+			if len(list) == 0 {
+				// like a filter, $all of nothing matches nothing
+				term = bson.D{{Key: "$literal", Value: false}}
+				break
+			}
+			term = bson.D{{Key: "$setIsSubset", Value: []any{aggLiteral(list), bson.D{{Key: "$ifNull", Value: []any{ref, []any{}}}}}}}
+		case "$size":
+			term = bson.D{{Key: "$eq", Value: []any{sizeExpr(ref), aggLiteral(e.Value)}}}
+		case "$not":
+			sub, ok := e.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$not needs a document")
+			}
+			inner, err := aggField(ref, sub)
+			if err != nil {
+				return nil, err
+			}
+			term = bson.D{{Key: "$not", Value: []any{inner}}}
+		case "$type":
+			var err error
+			if term, err = aggType(ref, e.Value); err != nil {
+				return nil, err
+			}
+		case "$elemMatch":
+			sub, ok := e.Value.(bson.D)
+			if !ok {
+				return nil, fmt.Errorf("$elemMatch needs a document")
+			}
+			// the condition is evaluated for each element, bound to $$elem
+			inner, err := aggFilter(sub, "$$elem.")
+			if err != nil {
+				return nil, err
+			}
+			term = bson.D{{Key: "$anyElementTrue", Value: []any{bson.D{{Key: "$map", Value: bson.D{
+				{Key: "input", Value: arrayOrEmpty(ref)},
+				{Key: "as", Value: "elem"},
+				{Key: "in", Value: inner},
+			}}}}}}
+		case "$exists":
+			op := "$eq"
+			if exists, _ := e.Value.(bool); exists {
+				op = "$ne"
+			}
+			term = bson.D{{Key: op, Value: []any{bson.D{{Key: "$type", Value: ref}}, "missing"}}}
+		case "$regex":
+			re, ok := e.Value.(primitive.Regex)
+			if !ok {
+				re.Pattern, _ = e.Value.(string)
+				if options, found := lookupKey(ops, "$options"); found {
+					re.Options, _ = options.(string)
+				}
+			}
+			term = aggRegex(ref, re)
+		case "$options":
+			continue
+		default:
+			return nil, fmt.Errorf("%s is not supported in aggregation expressions", e.Key)
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 1 {
+		return terms[0].(bson.D), nil
+	}
+	return bson.D{{Key: "$and", Value: terms}}, nil
+}
+
+func aggEquals(ref string, value any) bson.D {
+	if re, ok := value.(primitive.Regex); ok {
+		return aggRegex(ref, re)
+	}
+	if value == nil {
+		// a missing field is less than null, so this matches null and missing like a filter does
+		return bson.D{{Key: "$lte", Value: []any{ref, nil}}}
+	}
+	return bson.D{{Key: "$eq", Value: []any{ref, aggLiteral(value)}}}
+}
+
+// aggIn tests membership in a list; regexes and null in the list are matched separately.
+func aggIn(ref string, list []any) bson.D {
+	var values []any
+	var terms []any
+	for _, v := range list {
+		if re, ok := v.(primitive.Regex); ok {
+			terms = append(terms, aggRegex(ref, re))
+		} else if v == nil {
+			terms = append(terms, aggEquals(ref, nil))
+		} else {
+			values = append(values, v)
+		}
+	}
+	if len(values) > 0 || len(terms) == 0 {
+		terms = append([]any{bson.D{{Key: "$in", Value: []any{ref, aggLiteral(values)}}}}, terms...)
+	}
+	if len(terms) == 1 {
+		return terms[0].(bson.D)
+	}
+	return bson.D{{Key: "$or", Value: terms}}
+}
+
+// aggRegex matches a regex against ref, which is false rather than an error when ref is not a string, as $regexMatch
+// fails on numbers, arrays and other types.
+func aggRegex(ref string, re primitive.Regex) bson.D {
+	args := bson.D{{Key: "input", Value: ref}, {Key: "regex", Value: re.Pattern}}
+	if re.Options != "" {
+		args = append(args, bson.E{Key: "options", Value: re.Options})
+	}
+	isString := bson.D{{Key: "$eq", Value: []any{bson.D{{Key: "$type", Value: ref}}, "string"}}}
+	return bson.D{{Key: "$cond", Value: []any{isString, bson.D{{Key: "$regexMatch", Value: args}}, false}}}
+}
+
+// aggLiteral protects values that an aggregation expression would otherwise evaluate, e.g. strings starting with '$'
+// which would be read as field paths.
+func aggLiteral(v any) any {
+	switch tv := v.(type) {
+	case string:
+		if strings.HasPrefix(tv, "$") {
+			return bson.D{{Key: "$literal", Value: tv}}
+		}
+	case []any:
+		arr := make([]any, 0, len(tv))
+		for _, e := range tv {
+			arr = append(arr, aggLiteral(e))
+		}
+		return arr
+	case bson.D:
+		return bson.D{{Key: "$literal", Value: tv}}
+	}
+	return v
+}
+
+// aggFieldPaths rewrites the field paths of an $expr built by the parser to read from prefix.
+func aggFieldPaths(v any, prefix string) any {
+	switch tv := v.(type) {
+	case string:
+		if isFieldPath(tv) {
+			return prefix + tv[1:]
+		}
+	case bson.D:
+		d := make(bson.D, 0, len(tv))
+		for _, e := range tv {
+			if e.Key == "$literal" {
+				d = append(d, e)
+			} else {
+				d = append(d, bson.E{Key: e.Key, Value: aggFieldPaths(e.Value, prefix)})
+			}
+		}
+		return d
+	case []any:
+		arr := make([]any, 0, len(tv))
+		for _, e := range tv {
+			arr = append(arr, aggFieldPaths(e, prefix))
+		}
+		return arr
+	}
+	return v
+}
@@ -0,0 +1,104 @@
+package mongoq
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func (s *ReportSuite) TestMatchStage() {
+	stage, err := NewParser(WithScope(bson.D{{Key: "tenantId", Value: "acme"}})).MatchStage("name == Alice")
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "$match", Value: bson.D{{Key: "tenantId", Value: "acme"}, {Key: "name", Value: "Alice"}}}}, stage)
+
+	_, err = MatchStage("name ==")
+	s.Error(err)
+}
+
+func (s *ReportSuite) TestParseExpr() {
+	// $regexMatch fails on values that are not strings, so it is only evaluated for strings
+	regexMatch := func(ref string, args bson.D) bson.D {
+		isString := bson.D{{Key: "$eq", Value: []any{bson.D{{Key: "$type", Value: ref}}, "string"}}}
+		return bson.D{{Key: "$cond", Value: []any{isString, bson.D{{Key: "$regexMatch", Value: args}}, false}}}
+	}
+	vectors := []struct {
+		e string
+		r bson.D
+		x string
+	}{
+		{e: "name == Alice", r: bson.D{{Key: "$eq", Value: []any{"$name", "Alice"}}}},
+		{e: "age > 10 && name != \"$Bob\"", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "$gt", Value: []any{"$age", int64(10)}}},
+			bson.D{{Key: "$not", Value: []any{bson.D{{Key: "$eq", Value: []any{"$name", bson.D{{Key: "$literal", Value: "$Bob"}}}}}}}},
+		}}}},
+		{e: "age > 10 && age < 20", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "$gt", Value: []any{"$age", int64(10)}}},
+			bson.D{{Key: "$lt", Value: []any{"$age", int64(20)}}},
+		}}}},
+		{e: "age in 18..65", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "$gte", Value: []any{"$age", int64(18)}}},
+			bson.D{{Key: "$lt", Value: []any{"$age", int64(65)}}},
+		}}}},
+		{e: "a == 1 || !(b == 2)", r: bson.D{{Key: "$or", Value: []any{
+			bson.D{{Key: "$eq", Value: []any{"$a", int64(1)}}},
+			bson.D{{Key: "$not", Value: []any{bson.D{{Key: "$eq", Value: []any{"$b", int64(2)}}}}}},
+		}}}},
+		{e: "name == (a | \"b*\")", r: bson.D{{Key: "$or", Value: []any{
+			bson.D{{Key: "$in", Value: []any{"$name", []any{"a"}}}},
+			regexMatch("$name", bson.D{{Key: "input", Value: "$name"}, {Key: "regex", Value: "b.*"}, {Key: "options", Value: "i"}}),
+		}}}},
+		{e: "name != (a | b)", r: bson.D{{Key: "$not", Value: []any{bson.D{{Key: "$in", Value: []any{"$name", []any{"a", "b"}}}}}}}},
+		{e: "tags == (a & b)", r: bson.D{{Key: "$setIsSubset", Value: []any{[]any{"a", "b"}, bson.D{{Key: "$ifNull", Value: []any{"$tags", []any{}}}}}}}},
+		{e: "name in []", r: bson.D{{Key: "$in", Value: []any{"$name", []any{}}}}},
+		{e: "tags all []", r: bson.D{{Key: "$literal", Value: false}}},
+		{e: "owner == null", r: bson.D{{Key: "$lte", Value: []any{"$owner", nil}}}},
+		{e: "owner in [a, null]", r: bson.D{{Key: "$or", Value: []any{
+			bson.D{{Key: "$in", Value: []any{"$owner", []any{"a"}}}},
+			bson.D{{Key: "$lte", Value: []any{"$owner", nil}}},
+		}}}},
+		{e: "isType(v, number, array, date)", r: bson.D{{Key: "$or", Value: []any{
+			bson.D{{Key: "$isNumber", Value: "$v"}},
+			bson.D{{Key: "$isArray", Value: "$v"}},
+			bson.D{{Key: "$eq", Value: []any{bson.D{{Key: "$type", Value: "$v"}}, "date"}}},
+		}}}},
+		{e: "size(tags) != 2", r: bson.D{{Key: "$not", Value: []any{bson.D{{Key: "$eq", Value: []any{sizeExpr("$tags"), int64(2)}}}}}}},
+		{e: "size(tags) > 2", r: bson.D{{Key: "$gt", Value: []any{
+			bson.D{{Key: "$size", Value: bson.D{{Key: "$cond", Value: []any{bson.D{{Key: "$isArray", Value: "$tags"}}, "$tags", []any{}}}}}},
+			int64(2),
+		}}}},
+		{e: "elemMatch(readings, type == temp && value > 50)", r: bson.D{{Key: "$anyElementTrue", Value: []any{bson.D{{Key: "$map", Value: bson.D{
+			{Key: "input", Value: bson.D{{Key: "$cond", Value: []any{bson.D{{Key: "$isArray", Value: "$readings"}}, "$readings", []any{}}}}},
+			{Key: "as", Value: "elem"},
+			{Key: "in", Value: bson.D{{Key: "$and", Value: []any{
+				bson.D{{Key: "$eq", Value: []any{"$$elem.type", "temp"}}},
+				bson.D{{Key: "$gt", Value: []any{"$$elem.value", int64(50)}}},
+			}}}},
+		}}}}}}},
+		{e: "name == /^al/", r: regexMatch("$name", bson.D{{Key: "input", Value: "$name"}, {Key: "regex", Value: "^al"}})},
+		{e: "code == contains(x)", r: regexMatch("$code", bson.D{{Key: "input", Value: "$code"}, {Key: "regex", Value: ".*x.*"}, {Key: "options", Value: "i"}})},
+		{e: "name && !desc", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "$ne", Value: []any{bson.D{{Key: "$type", Value: "$name"}}, "missing"}}},
+			bson.D{{Key: "$eq", Value: []any{bson.D{{Key: "$type", Value: "$desc"}}, "missing"}}},
+		}}}},
+		{e: "temp > $threshold && type == a", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "$gt", Value: []any{"$temp", "$threshold"}}},
+			bson.D{{Key: "$eq", Value: []any{"$type", "a"}}},
+		}}}},
+		{e: "search(bob)", x: "1:1: $text is not supported in aggregation expressions"},
+	}
+	for _, v := range vectors {
+		rslt, err := ParseExpr(v.e)
+		if v.x != "" {
+			s.EqualError(err, v.x, v.e)
+			continue
+		}
+		s.NoError(err, v.e)
+		s.Equal(v.r, rslt, v.e)
+	}
+
+	rslt, err := defaultParser.ParseExprVar("value > 50", "this")
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "$gt", Value: []any{"$$this.value", int64(50)}}}, rslt)
+
+	rslt, err = defaultParser.ParseExprVar("value * 2 > $limit", "this")
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "$gt", Value: []any{bson.D{{Key: "$multiply", Value: []any{"$$this.value", int64(2)}}}, "$$this.limit"}}}, rslt)
+}
@@ -0,0 +1,321 @@
+package mongoq
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/qwerty-iot/tox"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errDivisionByZero        = errors.New("division by zero")
+	errUnsupportedArithmetic = errors.New("unsupported arithmetic")
+)
+
+var arithmeticOperators = map[tokenKind]string{
+	tokAdd: "$add",
+	tokSub: "$subtract",
+	tokMul: "$multiply",
+	tokQuo: "$divide",
+	tokRem: "$mod",
+}
+
+// isArithmetic reports whether n is an arithmetic expression, e.g. temp * 1.8 or -5.
+func isArithmetic(n node) bool {
+	switch e := n.(type) {
+	case *binaryExpr:
+		_, found := arithmeticOperators[e.Op]
+		return found
+	case *unaryExpr:
+		return e.Op == tokSub
+	case *parenExpr:
+		return isArithmetic(e.X)
+	}
+	return false
+}
+
+// foldConstants replaces arithmetic on numbers with its result, e.g. 9 / 5 with 1.8.
+func foldConstants(n node) (node, error) {
+	switch e := n.(type) {
+	case *parenExpr:
+		x, err := foldConstants(e.X)
+		if err != nil {
+			return nil, err
+		}
+		if _, isLit := x.(*basicLit); isLit {
+			return x, nil
+		}
+		return &parenExpr{Lparen: e.Lparen, X: x, Rparen: e.Rparen}, nil
+	case *unaryExpr:
+		if e.Op != tokSub {
+			return n, nil
+		}
+		x, err := foldConstants(e.X)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := numericLiteral(x); ok {
+			return constantLiteral(e, negate(v)), nil
+		}
+		return &unaryExpr{Op: e.Op, OpPos: e.OpPos, X: x}, nil
+	case *binaryExpr:
+		if _, found := arithmeticOperators[e.Op]; !found {
+			return n, nil
+		}
+		x, err := foldConstants(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := foldConstants(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		l, lok := numericLiteral(x)
+		r, rok := numericLiteral(y)
+		if rok && (e.Op == tokQuo || e.Op == tokRem) {
+			if rf, _ := toFloat(r); rf == 0 {
+				return nil, opError(e, "", "%v", errDivisionByZero)
+			}
+		}
+		if !lok || !rok {
+			return &binaryExpr{Op: e.Op, OpPos: e.OpPos, OpEnd: e.OpEnd, X: x, Y: y}, nil
+		}
+		v, err := applyArithmetic(e.Op, l, r)
+		if err != nil {
+			return nil, opError(e, "", "%v", err)
+		}
+		return constantLiteral(e, v), nil
+	}
+	return n, nil
+}
+
+func numericLiteral(n node) (any, bool) {
+	if lit, ok := n.(*basicLit); ok {
+		switch lit.Kind {
+		case tokInt:
+			return tox.ToInt64(lit.Value), true
+		case tokFloat:
+			return tox.ToFloat64(lit.Value), true
+		}
+	}
+	return nil, false
+}
+
+// constantLiteral returns a literal for v spanning the expression it was folded from.
+func constantLiteral(n node, v any) *basicLit {
+	lit := &basicLit{ValuePos: n.Pos(), ValueEnd: n.End()}
+	switch tv := v.(type) {
+	case int64:
+		lit.Kind, lit.Value = tokInt, strconv.FormatInt(tv, 10)
+	case float64:
+		lit.Kind, lit.Value = tokFloat, strconv.FormatFloat(tv, 'g', -1, 64)
+	}
+	return lit
+}
+
+func negate(v any) any {
+	if i, ok := v.(int64); ok {
+		return -i
+	}
+	return -v.(float64)
+}
+
+// applyArithmetic evaluates l op r the way MongoDB does: integers stay integers except for division, which always
+// produces a double.
+func applyArithmetic(op tokenKind, l any, r any) (any, error) {
+	li, lint := l.(int64)
+	ri, rint := r.(int64)
+	if lint && rint && op != tokQuo {
+		switch op {
+		case tokAdd:
+			return li + ri, nil
+		case tokSub:
+			return li - ri, nil
+		case tokMul:
+			return li * ri, nil
+		case tokRem:
+			if ri == 0 {
+				return nil, errDivisionByZero
+			}
+			return li % ri, nil
+		}
+	}
+	lf, _ := toFloat(l)
+	rf, _ := toFloat(r)
+	switch op {
+	case tokAdd:
+		return lf + rf, nil
+	case tokSub:
+		return lf - rf, nil
+	case tokMul:
+		return lf * rf, nil
+	case tokQuo:
+		if rf == 0 {
+			return nil, errDivisionByZero
+		}
+		return lf / rf, nil
+	case tokRem:
+		if rf == 0 {
+			return nil, errDivisionByZero
+		}
+		return math.Mod(lf, rf), nil
+	}
+	return nil, errUnsupportedArithmetic
+}
+
+// convertArithmeticComparison converts a comparison involving arithmetic.  If the arithmetic folds into a number it
+// is an ordinary comparison, otherwise an $expr with $add, $subtract, $multiply, $divide and $mod.  Identifiers inside
+// arithmetic on the left are fields; on the right, fields are written $name or field(name), and a single operand keeps
+// its usual meaning as a value, except that a bare word is rejected as it would silently be compared as a string.
+func (c *converter) convertArithmeticComparison(e *binaryExpr, operator string, parentOp *tokenKind) (any, error) {
+	x, err := foldConstants(e.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := foldConstants(e.Y)
+	if err != nil {
+		return nil, err
+	}
+	folded := &binaryExpr{Op: e.Op, OpPos: e.OpPos, OpEnd: e.OpEnd, X: x, Y: y}
+	if !isArithmetic(x) && !isArithmetic(y) {
+		return c.convertBinaryOp(folded, parentOp)
+	}
+
+	left, err := c.arithmeticOperand(x, operator, false)
+	if err != nil {
+		return nil, err
+	}
+	var right any
+	if isArithmetic(y) {
+		right, err = c.arithmeticOperand(y, operator, true)
+	} else if id, ok := y.(*ident); ok && !isFieldRefName(id.Name) {
+		err = bareOperand(id)
+	} else {
+		right, err = c.comparisonValue(y, operator, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: "$expr", Value: bson.D{{Key: operator, Value: []any{left, right}}}}}, nil
+}
+
+// arithmeticOperand converts an operand of arithmetic into an aggregation expression.  On the right of the comparison
+// bare words and quoted strings are rejected rather than read as fields, as name == Alice-Smith is more likely a value.
+func (c *converter) arithmeticOperand(n node, operator string, right bool) (any, error) {
+	switch e := n.(type) {
+	case *parenExpr:
+		return c.arithmeticOperand(e.X, operator, right)
+	case *binaryExpr:
+		op, found := arithmeticOperators[e.Op]
+		if !found {
+			return nil, opError(e, "arithmetic works on numbers and fields", "unsupported use of: %s", e.Op)
+		}
+		l, err := c.arithmeticOperand(e.X, operator, right)
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.arithmeticOperand(e.Y, operator, right)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: op, Value: []any{l, r}}}, nil
+	case *unaryExpr:
+		if e.Op != tokSub {
+			return nil, newParseError(CodeUnsupportedOperator, e.OpPos, e.OpPos+1, "arithmetic works on numbers and fields", "unsupported use of: %s", e.Op)
+		}
+		x, err := c.arithmeticOperand(e.X, operator, right)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$multiply", Value: []any{int64(-1), x}}}, nil
+	case *basicLit:
+		if v, ok := numericLiteral(e); ok {
+			return v, nil
+		}
+		if e.Kind == tokString && !right {
+			// quoted field names, as on the left of a comparison
+			return c.arithmeticField(e.Value, e, operator)
+		}
+	case *ident:
+		name := e.Name
+		if isFieldRefName(name) {
+			name = name[1:]
+		} else if right {
+			return nil, bareOperand(e)
+		}
+		return c.arithmeticField(name, e, operator)
+	case *callExpr:
+		parentOp := tokAdd
+		v, err := c.convertCallExpr(e, &parentOp)
+		if err != nil {
+			return nil, err
+		}
+		switch tv := v.(type) {
+		case *fieldRef:
+			return c.arithmeticField(tv.name, tv.n, operator)
+		case *arraySize:
+			return tv.expr(), nil
+		case int64, int32, float64, time.Time:
+			return tv, nil
+		}
+	case *paramExpr:
+		parentOp := tokAdd
+		v, err := c.convertParam(e, &parentOp)
+		if err != nil {
+			return nil, err
+		}
+		switch tv := v.(type) {
+		case int64, float64, time.Time, primitive.DateTime, primitive.Decimal128:
+			return tv, nil
+		}
+	}
+	return nil, nodeError(CodeInvalidOperand, n, "arithmetic works on numbers and fields", "invalid operand for arithmetic")
+}
+
+// bareOperand reports a bare word on the right of a comparison with arithmetic, which is neither clearly a field nor
+// a value.
+func bareOperand(e *ident) error {
+	return nodeError(CodeInvalidOperand, e, "write fields on the right as $name or field(name), or quote a value", "invalid operand for arithmetic: %s", e.Name)
+}
+
+func (c *converter) arithmeticField(name string, n node, operator string) (any, error) {
+	path, f, err := c.resolveField(name, n, operator)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil && f.Type != TypeAny && f.Type != TypeDate && !isNumericType(f.Type) {
+		return nil, nodeError(CodeTypeMismatch, n, "", "field %s is a %s field and cannot be used in arithmetic", name, f.Type)
+	}
+	return "$" + path, nil
+}
+
+// comparisonValue converts the single operand on the right of a comparison with arithmetic.
+func (c *converter) comparisonValue(n node, operator string, e *binaryExpr) (any, error) {
+	v, err := c.convertExprToMongoQuery(n, &e.Op)
+	if err != nil {
+		return nil, err
+	}
+	switch tv := v.(type) {
+	case *fieldRef:
+		return c.arithmeticField(tv.name, tv.n, operator)
+	case *arraySize:
+		return tv.expr(), nil
+	case bson.D, []any, primitive.Regex:
+		return nil, nodeError(CodeInvalidOperand, n, "compare the result with a single value", "invalid right operand for operator '%s'", e.Op)
+	}
+	return aggLiteral(v), nil
+}
+
+// arithmeticOperator returns the token of an aggregation arithmetic operator, e.g. tokAdd for $add.
+func arithmeticOperator(op string) (tokenKind, bool) {
+	for kind, name := range arithmeticOperators {
+		if name == op {
+			return kind, true
+		}
+	}
+	return tokIllegal, false
+}
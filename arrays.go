@@ -0,0 +1,126 @@
+package mongoq
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// arraySize is the number of elements of an array field, written as size(tags) on the left of a comparison.
+type arraySize struct {
+	path string
+	n    node
+}
+
+func (s *arraySize) misplaced() error {
+	return nodeError(CodeInvalidOperand, s.n, "compare it with a number, e.g. size(tags) > 2", "size() can only be compared with a number")
+}
+
+// expr returns the aggregation expression for the number of elements.
+func (s *arraySize) expr() bson.D {
+	return sizeExpr("$" + s.path)
+}
+
+// sizeExpr counts the elements of the array ref refers to; a value that is not an array counts as empty instead of
+// failing the whole query.
+func sizeExpr(ref string) bson.D {
+	return bson.D{{Key: "$size", Value: arrayOrEmpty(ref)}}
+}
+
+func arrayOrEmpty(ref string) bson.D {
+	return bson.D{{Key: "$cond", Value: []any{bson.D{{Key: "$isArray", Value: ref}}, ref, []any{}}}}
+}
+
+// sizeField returns the field path counted by an expression built by sizeExpr.
+func sizeField(v any) (string, bool) {
+	doc, ok := asFilter(v)
+	if !ok || len(doc) != 1 {
+		return "", false
+	}
+	cond, ok := asFilter(doc["$size"])
+	if !ok || len(cond) != 1 {
+		return "", false
+	}
+	args, ok := asArray(cond["$cond"])
+	if !ok || len(args) != 3 {
+		return "", false
+	}
+	test, ok := asFilter(args[0])
+	if !ok || len(test) != 1 {
+		return "", false
+	}
+	ref, ok := args[1].(string)
+	if !ok || !isFieldPath(ref) || test["$isArray"] != ref {
+		return "", false
+	}
+	return ref[1:], true
+}
+
+func callSize(call *Call) (any, error) {
+	path, err := call.Field(0, "$size")
+	if err != nil {
+		return nil, err
+	}
+	return &arraySize{path: path, n: call.e}, nil
+}
+
+// compareSize builds the condition for a comparison of size() with a number.  == and != use $size, the other
+// comparisons, and comparisons of two sizes, need an $expr.
+func (c *converter) compareSize(operator string, size *arraySize, e *binaryExpr) (bson.D, error) {
+	right, err := c.convertExprToMongoQuery(e.Y, &e.Op)
+	if err != nil {
+		return nil, err
+	}
+	if other, ok := right.(*arraySize); ok {
+		return bson.D{{Key: "$expr", Value: bson.D{{Key: operator, Value: []any{size.expr(), other.expr()}}}}}, nil
+	}
+	count, ok := right.(int64)
+	if !ok || count < 0 {
+		return nil, nodeError(CodeInvalidOperand, e.Y, "size() counts the elements of an array", "size() must be compared with a whole number")
+	}
+	switch operator {
+	case "$eq":
+		return bson.D{{Key: size.path, Value: bson.D{{Key: "$size", Value: count}}}}, nil
+	case "$ne":
+		return bson.D{{Key: size.path, Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$size", Value: count}}}}}}, nil
+	}
+	return bson.D{{Key: "$expr", Value: bson.D{{Key: operator, Value: []any{size.expr(), count}}}}}, nil
+}
+
+// callElemMatch matches arrays with at least one element satisfying the condition, e.g.
+// elemMatch(readings, type == temp && value > 50).  Fields in the condition are relative to the elements.
+func callElemMatch(call *Call) (any, error) {
+	path, err := call.Field(0, "$elemMatch")
+	if err != nil {
+		return nil, err
+	}
+	cond := call.Args[1].(bson.D)
+	if op, found := topLevelOperator(cond); found {
+		return nil, call.ArgError(1, "field comparisons, arithmetic, size() ranges and search() only work outside elemMatch()", "elemMatch() condition cannot use %s", op)
+	}
+	return bson.D{{Key: path, Value: bson.D{{Key: "$elemMatch", Value: cond}}}}, nil
+}
+
+// topLevelOperator returns the first operator in filter that MongoDB only accepts at the top level of a query.
+func topLevelOperator(filter bson.D) (string, bool) {
+	for _, e := range filter {
+		switch e.Key {
+		case "$expr", "$text":
+			return e.Key, true
+		case "$and", "$or", "$nor":
+			subs, _ := e.Value.([]any)
+			for _, sub := range subs {
+				if d, ok := sub.(bson.D); ok {
+					if op, found := topLevelOperator(d); found {
+						return op, true
+					}
+				}
+			}
+		case "$not":
+			if d, ok := e.Value.(bson.D); ok {
+				if op, found := topLevelOperator(d); found {
+					return op, true
+				}
+			}
+		}
+	}
+	return "", false
+}
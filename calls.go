@@ -1,110 +1,89 @@
 package mongoq
 
 import (
-	"fmt"
-	"go/ast"
-	"go/token"
+	"regexp"
 	"strings"
-	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func convertCallArgsToStringArray(name string, args []ast.Expr, expected int) ([]string, error) {
-	var arr []string
-	for _, arg := range args {
-		switch targ := arg.(type) {
-		case *ast.BasicLit:
-			arr = append(arr, strings.Trim(targ.Value, `"`))
-		case *ast.Ident:
-			arr = append(arr, targ.Name)
-		case *ast.SelectorExpr:
-			// Handle selector expressions (e.g. "foo.bar")
-			if id, ok := targ.X.(*ast.Ident); ok {
-				arr = append(arr, id.Name+"."+targ.Sel.Name)
-			}
-		default:
-			return nil, fmt.Errorf("%s() unsupported argument type: %v", name, arg)
+func builtinFunctions() *registry {
+	r := newRegistry(nil)
+	for _, fn := range []Function{
+		{Name: "contains", Args: []ArgSpec{{Name: "value", Type: ArgString}}, Call: callContains},
+		{Name: "startsWith", Args: []ArgSpec{{Name: "value", Type: ArgString}}, Call: callStartsWith},
+		{Name: "endsWith", Args: []ArgSpec{{Name: "value", Type: ArgString}}, Call: callEndsWith},
+		{Name: "field", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callField},
+		{Name: "exists", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callExists},
+		{Name: "nexists", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callNotExists},
+		{Name: "regex", Args: []ArgSpec{{Name: "pattern", Type: ArgString}}, Call: callRegex},
+		{Name: "date", Args: []ArgSpec{{Name: "value", Type: ArgString}, {Name: "layout", Type: ArgString, Optional: true}, {Name: "tz", Type: ArgString, Optional: true}}, Call: callDate},
+		{Name: "dateRelative", Args: []ArgSpec{{Name: "duration", Type: ArgString}, {Name: "tz", Type: ArgString, Optional: true}}, Volatile: true, Call: callDateRelative},
+		{Name: "now", Volatile: true, Call: callNow},
+		{Name: "today", Args: []ArgSpec{{Name: "tz", Type: ArgString, Optional: true}}, Volatile: true, Call: callToday},
+		{Name: "startOf", Args: []ArgSpec{{Name: "unit", Type: ArgString}, {Name: "tz", Type: ArgString, Optional: true}}, Volatile: true, Call: callStartOf},
+		{Name: "endOf", Args: []ArgSpec{{Name: "unit", Type: ArgString}, {Name: "tz", Type: ArgString, Optional: true}}, Volatile: true, Call: callEndOf},
+		{Name: "between", Args: []ArgSpec{{Name: "field", Type: ArgField}, {Name: "low", Type: ArgAny}, {Name: "high", Type: ArgAny}}, Call: callBetween},
+		{Name: "epoch", Args: []ArgSpec{{Name: "value", Type: ArgNumber}}, Call: callEpoch},
+		{Name: "search", Args: []ArgSpec{{Name: "terms", Type: ArgString}}, Variadic: true, Call: callSearch},
+		{Name: "str", Args: []ArgSpec{{Name: "value", Type: ArgString}}, Call: callStr},
+		{Name: "elemMatch", Args: []ArgSpec{{Name: "field", Type: ArgField}, {Name: "condition", Type: ArgCondition}}, Call: callElemMatch},
+		{Name: "size", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callSize},
+		{Name: "isType", Args: []ArgSpec{{Name: "field", Type: ArgField}, {Name: "type", Type: ArgString}}, Variadic: true, Call: callIsType},
+		{Name: "isNumber", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callIsNumber},
+		{Name: "isString", Args: []ArgSpec{{Name: "field", Type: ArgField}}, Call: callIsString},
+	} {
+		if err := r.register(fn); err != nil {
+			panic(err)
 		}
 	}
-	if len(arr) < expected {
-		return nil, fmt.Errorf("%s() expected %d arguments, got %d", name, expected, len(arr))
-	}
-	return arr, nil
+	return r
 }
 
-func callSearch(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("search", e.Args, -1)
-	if err != nil {
-		return nil, err
-	}
-	return bson.M{"$text": bson.M{"$search": strings.Join(args, " ")}}, nil
+func callSearch(call *Call) (any, error) {
+	return bson.D{{Key: "$text", Value: bson.D{{Key: "$search", Value: strings.Join(call.Strings(0), " ")}}}}, nil
 }
 
-func callExists(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("exists", e.Args, 1)
-	if err != nil {
-		return nil, err
-	}
-	return bson.M{args[0]: bson.M{"$exists": true}}, nil
+// callStr returns its argument verbatim, without wildcard, regex or ObjectID detection.
+func callStr(call *Call) (any, error) {
+	return call.String(0), nil
 }
 
-func callNotExists(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("nexists", e.Args, 1)
+func callExists(call *Call) (any, error) {
+	path, err := call.Field(0, "$exists")
 	if err != nil {
 		return nil, err
 	}
-	return bson.M{args[0]: bson.M{"$exists": false}}, nil
+	return bson.D{{Key: path, Value: bson.D{{Key: "$exists", Value: true}}}}, nil
 }
 
-func callContains(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("like", e.Args, 1)
+func callNotExists(call *Call) (any, error) {
+	path, err := call.Field(0, "$exists")
 	if err != nil {
 		return nil, err
 	}
-	return primitive.Regex{Pattern: ".*" + args[0] + ".*", Options: "i"}, nil
+	return bson.D{{Key: path, Value: bson.D{{Key: "$exists", Value: false}}}}, nil
 }
 
-func callRegex(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("regex", e.Args, 1)
-	if err != nil {
-		return nil, err
-	}
-	pattern := strings.Replace(args[0], "\\\\", "\\", -1)
-	return primitive.Regex{Pattern: pattern}, nil
+// callContains, callStartsWith and callEndsWith match their argument literally, so they are safe to use with
+// WithRegex(false).
+func callContains(call *Call) (any, error) {
+	return primitive.Regex{Pattern: ".*" + regexp.QuoteMeta(call.String(0)) + ".*", Options: call.Parser.regexOptions()}, nil
 }
 
-func callDateRelative(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("dateRelative", e.Args, 1)
-	if err != nil {
-		return nil, err
-	}
-	dur, err := time.ParseDuration(args[0])
-	if err != nil {
-		return nil, err
-	}
-	ts := time.Now().UTC().Add(dur)
-	return ts, nil
+func callStartsWith(call *Call) (any, error) {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(call.String(0)), Options: call.Parser.regexOptions()}, nil
 }
 
-func callDate(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	args, err := convertCallArgsToStringArray("date", e.Args, 1)
-	if err != nil {
-		return nil, err
-	}
-	if len(args) == 1 {
-		ts, err := time.Parse(time.RFC3339, args[0])
-		if err != nil {
-			return nil, err
-		}
-		return ts, nil
-	} else {
-		ts, err := time.Parse(args[1], args[0])
-		if err != nil {
-			return nil, err
-		}
-		return ts, nil
+func callEndsWith(call *Call) (any, error) {
+	return primitive.Regex{Pattern: regexp.QuoteMeta(call.String(0)) + "$", Options: call.Parser.regexOptions()}, nil
+}
+
+func callRegex(call *Call) (any, error) {
+	if !call.Parser.regex {
+		return nil, nodeError(CodeUnsupportedFunction, call.e.Fun, "use contains() or a wildcard instead", "regular expressions are not allowed")
 	}
+	return primitive.Regex{Pattern: call.String(0), Options: call.Parser.regexOptions()}, nil
 }
@@ -0,0 +1,200 @@
+package mongoq
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CompiledQuery is an expression that has been parsed and converted once, and can then be rendered into a filter any
+// number of times.  It is immutable and safe for concurrent use; every rendering returns a new filter that the caller
+// may modify.  Expressions using volatile functions such as dateRelative() are converted again on each rendering, so
+// that relative times are computed when the query runs rather than when it was compiled.
+type CompiledQuery struct {
+	p        *Parser
+	expr     string
+	ast      node
+	filter   bson.D // the filter without the scope, unless volatile
+	volatile bool
+}
+
+// Compile compiles expr with the default parser.
+func Compile(expr string) (*CompiledQuery, error) {
+	return defaultParser.Compile(expr)
+}
+
+// Compile parses and converts expr into a CompiledQuery, or returns the cached one if the parser was created with
+// WithCache and has already compiled the same expression.
+func (p *Parser) Compile(expr string) (*CompiledQuery, error) {
+	// the length is checked before the cache, which would otherwise accept a longer spelling of a cached expression
+	if err := p.checkLength(expr); err != nil {
+		return nil, err
+	}
+	var key string
+	if p.cache != nil {
+		key = normalizeExpr(expr)
+		if q, found := p.cache.get(key); found {
+			return q, nil
+		}
+	}
+	exprAst, err := p.parseAST(expr)
+	if err != nil {
+		return nil, err
+	}
+	d, volatile, err := p.convert(expr, exprAst, nil, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	q := &CompiledQuery{p: p, expr: expr, ast: exprAst, volatile: volatile}
+	if !volatile {
+		q.filter = d
+	}
+	if p.cache != nil {
+		p.cache.add(key, q)
+	}
+	return q, nil
+}
+
+// String returns the expression the query was compiled from.
+func (q *CompiledQuery) String() string {
+	return q.expr
+}
+
+// Volatile reports whether the query calls volatile functions and is converted again each time it is rendered.
+func (q *CompiledQuery) Volatile() bool {
+	return q.volatile
+}
+
+// Render returns the filter, including the parser's scope, as Parse does.
+func (q *CompiledQuery) Render() (bson.M, error) {
+	d, err := q.RenderD()
+	if err != nil {
+		return nil, err
+	}
+	return toMap(d).(bson.M), nil
+}
+
+// RenderD returns the filter with its keys in the order they were written, as ParseD does.
+func (q *CompiledQuery) RenderD() (bson.D, error) {
+	return q.RenderDAt(time.Time{})
+}
+
+// RenderAt is like Render, but evaluates volatile functions as if the current time were now, e.g. to show what a
+// saved filter matched at a point in the past.
+func (q *CompiledQuery) RenderAt(now time.Time) (bson.M, error) {
+	d, err := q.RenderDAt(now)
+	if err != nil {
+		return nil, err
+	}
+	return toMap(d).(bson.M), nil
+}
+
+// RenderDAt is like RenderD, but evaluates volatile functions as if the current time were now.
+func (q *CompiledQuery) RenderDAt(now time.Time) (bson.D, error) {
+	d, err := q.filterD(now)
+	if err != nil {
+		return nil, err
+	}
+	return q.p.scoped(d), nil
+}
+
+// filterD returns a copy of the filter without the scope, converting the expression again at now, or the parser's
+// clock if now is zero, if it is volatile.
+func (q *CompiledQuery) filterD(now time.Time) (bson.D, error) {
+	if q.volatile {
+		d, _, err := q.p.convert(q.expr, q.ast, nil, now)
+		return d, err
+	}
+	return toDocument(q.filter).(bson.D), nil
+}
+
+// normalizeExpr returns the cache key of expr: its tokens, so that differences in spacing do not matter.  Spacing
+// after a sign is kept, as -15m is a single operand but - 15m is not.  An expression that cannot be scanned is its own
+// key, and fails to compile anyway.
+func normalizeExpr(expr string) string {
+	var b strings.Builder
+	l := newLexer(expr)
+	var prev token
+	for {
+		tok := l.next()
+		switch tok.kind {
+		case tokEOF:
+			return b.String()
+		case tokIllegal:
+			return expr
+		}
+		if (prev.kind == tokSub || prev.kind == tokAdd) && tok.pos > prev.end {
+			b.WriteString("_ ")
+		}
+		prev = tok
+		b.WriteString(strconv.Itoa(int(tok.kind)))
+		b.WriteString(strconv.Quote(tok.lit))
+		b.WriteString(tok.opts)
+		b.WriteByte(' ')
+	}
+}
+
+// queryCache is a fixed-size cache of compiled queries that evicts the least recently used one.
+type queryCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key string
+	q   *CompiledQuery
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *queryCache) get(key string) (*CompiledQuery, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).q, true
+}
+
+func (c *queryCache) add(key string, q *CompiledQuery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		el.Value.(*cacheEntry).q = q
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, q: q})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *queryCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// purge empties the cache, e.g. after a function is registered.  It does nothing on a nil cache.
+func (c *queryCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
@@ -0,0 +1,271 @@
+package mongoq
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// epochMillis is the smallest epoch() value read as milliseconds: as seconds it would be in the year 5138, while as
+// milliseconds it is in 1973.
+const epochMillis = 100_000_000_000
+
+// locations caches the time zones loaded by name, as loading one reads the time zone database.
+var locations sync.Map
+
+// callLocation returns argument i as an IANA time zone, or UTC if it was not supplied.
+func callLocation(call *Call, i int) (*time.Location, error) {
+	name := call.String(i)
+	if name == "" || name == "UTC" {
+		return time.UTC, nil
+	}
+	if loc, found := locations.Load(name); found {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" { // Local would depend on the server the query runs on
+		return nil, call.ArgError(i, "use an IANA time zone such as Europe/Berlin", "%s() unknown time zone: %s", call.Name, name)
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// callDate parses an RFC 3339 date, or a date in the layout of the second argument, which is read in the time zone
+// of the optional third argument if it has none of its own.
+func callDate(call *Call) (any, error) {
+	if len(call.Args) == 1 {
+		ts, err := time.Parse(time.RFC3339, call.String(0))
+		if err != nil {
+			return nil, call.ArgError(0, "use an RFC 3339 date such as 2020-12-01T00:00:00Z", "date() %s", err.Error())
+		}
+		return ts, nil
+	}
+	loc, err := callLocation(call, 2)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := time.ParseInLocation(call.String(1), call.String(0), loc)
+	if err != nil {
+		return nil, call.ArgError(0, "the date must match the layout in the second argument", "date() %s", err.Error())
+	}
+	return ts, nil
+}
+
+// callDateRelative returns the current time moved by a duration such as -15m, -7d or P1M.  Days, weeks, months and
+// years are calendar units counted in the optional time zone, so -1d is the same time yesterday even across a change
+// to or from daylight saving time.
+func callDateRelative(call *Call) (any, error) {
+	off, err := parseOffset(call.String(0))
+	if err != nil {
+		return nil, call.ArgError(0, "use a duration such as -15m, 2h, -7d, 1mo or P1DT12H", "dateRelative() %s", err.Error())
+	}
+	loc, err := callLocation(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	return off.addTo(call.Now().In(loc)).UTC(), nil
+}
+
+func callNow(call *Call) (any, error) {
+	return call.Now().UTC(), nil
+}
+
+// callToday returns the start of the current day in the optional time zone.
+func callToday(call *Call) (any, error) {
+	loc, err := callLocation(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	ts, _ := startOf(call.Now().In(loc), "day")
+	return ts.UTC(), nil
+}
+
+// callStartOf returns the start of the current day, week (starting on Monday), month or year in the optional time
+// zone.
+func callStartOf(call *Call) (any, error) {
+	start, _, err := callPeriod(call)
+	if err != nil {
+		return nil, err
+	}
+	return start.UTC(), nil
+}
+
+// callEndOf returns the last millisecond, the precision of a BSON date, of the current day, week, month or year, so
+// that ts <= endOf("day") includes the whole day.
+func callEndOf(call *Call) (any, error) {
+	_, next, err := callPeriod(call)
+	if err != nil {
+		return nil, err
+	}
+	return next.Add(-time.Millisecond).UTC(), nil
+}
+
+// callPeriod returns the start of the current period and of the next one.
+func callPeriod(call *Call) (time.Time, time.Time, error) {
+	loc, err := callLocation(call, 1)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	unit := call.String(0)
+	start, ok := startOf(call.Now().In(loc), unit)
+	if !ok {
+		return time.Time{}, time.Time{}, call.ArgError(0, "units are day, week, month and year", "%s() unknown unit: %s", call.Name, unit)
+	}
+	switch unit {
+	case "day":
+		return start, start.AddDate(0, 0, 1), nil
+	case "week":
+		return start, start.AddDate(0, 0, 7), nil
+	case "month":
+		return start, start.AddDate(0, 1, 0), nil
+	}
+	return start, start.AddDate(1, 0, 0), nil
+}
+
+// startOf returns the start of the day, week, month or year t is in, in t's time zone.
+func startOf(t time.Time, unit string) (time.Time, bool) {
+	y, m, d := t.Date()
+	switch unit {
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location()), true
+	case "week":
+		monday := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-monday, 0, 0, 0, 0, t.Location()), true
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), true
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()), true
+	}
+	return time.Time{}, false
+}
+
+// callEpoch converts seconds, or milliseconds for values of epochMillis and more, since 1970-01-01 UTC into a date.
+func callEpoch(call *Call) (any, error) {
+	switch v := call.Args[0].(type) {
+	case int64:
+		if v >= epochMillis || v <= -epochMillis {
+			return time.UnixMilli(v).UTC(), nil
+		}
+		return time.Unix(v, 0).UTC(), nil
+	case float64:
+		if math.Abs(v) >= epochMillis {
+			return time.UnixMilli(int64(v)).UTC(), nil
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	return nil, call.ArgError(0, "", "epoch() value must be a number")
+}
+
+// offset is a duration that can include calendar units, whose length depends on the date they are added to.
+type offset struct {
+	years, months, days int
+	dur                 time.Duration
+}
+
+func (o offset) addTo(t time.Time) time.Time {
+	return t.AddDate(o.years, o.months, o.days).Add(o.dur)
+}
+
+func (o offset) negate() offset {
+	return offset{years: -o.years, months: -o.months, days: -o.days, dur: -o.dur}
+}
+
+// isoDuration matches ISO 8601 durations such as P1Y2M, P2W or PT1H30M, after the P.
+var isoDuration = regexp.MustCompile(`^(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
+
+// parseOffset parses a Go duration such as -1h30m, extended with the units y, mo, w and d (e.g. -7d or 1mo2w), or an
+// ISO 8601 duration such as -P1DT12H.
+func parseOffset(s string) (offset, error) {
+	if dur, err := time.ParseDuration(s); err == nil {
+		return offset{dur: dur}, nil
+	}
+	rest, negative := s, false
+	if strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, "+") {
+		rest, negative = rest[1:], rest[0] == '-'
+	}
+	var off offset
+	var ok bool
+	if strings.HasPrefix(rest, "P") {
+		off, ok = parseISODuration(rest[1:])
+	} else {
+		off, ok = parseUnits(rest)
+	}
+	if !ok {
+		return offset{}, fmt.Errorf("invalid duration %q", s)
+	}
+	if negative {
+		off = off.negate()
+	}
+	return off, nil
+}
+
+// parseUnits parses a sequence of numbers with units, the calendar units taking whole numbers only.
+func parseUnits(s string) (offset, bool) {
+	var off offset
+	if s == "" {
+		return off, false
+	}
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return !isNumberRune(r) })
+		if i <= 0 {
+			return off, false
+		}
+		j := strings.IndexFunc(s[i:], isNumberRune)
+		if j < 0 {
+			j = len(s) - i
+		}
+		number, unit := s[:i], s[i:i+j]
+		s = s[i+j:]
+		switch unit {
+		case "y", "mo", "w", "d":
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return off, false
+			}
+			switch unit {
+			case "y":
+				off.years += n
+			case "mo":
+				off.months += n
+			case "w":
+				off.days += 7 * n
+			case "d":
+				off.days += n
+			}
+		default:
+			dur, err := time.ParseDuration(number + unit)
+			if err != nil {
+				return off, false
+			}
+			off.dur += dur
+		}
+	}
+	return off, true
+}
+
+func isNumberRune(r rune) bool {
+	return (r >= '0' && r <= '9') || r == '.'
+}
+
+func parseISODuration(s string) (offset, bool) {
+	m := isoDuration.FindStringSubmatch(s)
+	if m == nil || s == "" || strings.HasSuffix(s, "T") {
+		return offset{}, false
+	}
+	n := func(i int) int {
+		v, _ := strconv.Atoi(m[i])
+		return v
+	}
+	off := offset{years: n(1), months: n(2), days: 7*n(3) + n(4)}
+	off.dur = time.Duration(n(5))*time.Hour + time.Duration(n(6))*time.Minute
+	if m[7] != "" {
+		seconds, _ := strconv.ParseFloat(strings.Replace(m[7], ",", ".", 1), 64)
+		off.dur += time.Duration(seconds * float64(time.Second))
+	}
+	return off, true
+}
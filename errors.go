@@ -0,0 +1,93 @@
+package mongoq
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrorCode classifies a ParseError.
+type ErrorCode string
+
+const (
+	CodeSyntax              ErrorCode = "syntax"
+	CodeUnsupportedOperator ErrorCode = "unsupported_operator"
+	CodeInvalidOperand      ErrorCode = "invalid_operand"
+	CodeUnsupportedFunction ErrorCode = "unsupported_function"
+	CodeInvalidArgument     ErrorCode = "invalid_argument"
+	CodeInvalidExpression   ErrorCode = "invalid_expression"
+	CodeLimitExceeded       ErrorCode = "limit_exceeded"
+	CodeUnknownField        ErrorCode = "unknown_field"
+	CodeOperatorNotAllowed  ErrorCode = "operator_not_allowed"
+	CodeTypeMismatch        ErrorCode = "type_mismatch"
+	CodeInvalidParam        ErrorCode = "invalid_param"
+)
+
+// ErrLimitExceeded matches, using errors.Is, a ParseError caused by one of the parser's Limits.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// ParseError is returned for every failure to parse or convert an expression.  Offset and Line/Column refer to the
+// expression as the user typed it, so a UI can underline Token directly; Offset counts bytes, and Column counts
+// characters so that text such as smart quotes before the error does not shift it.
+type ParseError struct {
+	Input  string    // the original expression
+	Offset int       // byte offset of Token in Input
+	Line   int       // 1-based line of Offset
+	Column int       // 1-based column of Offset, in characters
+	Token  string    // the offending text, or "EOF"
+	Code   ErrorCode // machine readable category
+	Msg    string    // description of the problem
+	Hint   string    // optional suggestion for the user
+
+	end int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// Is reports whether the error is ErrLimitExceeded and was caused by a limit.
+func (e *ParseError) Is(target error) bool {
+	return target == ErrLimitExceeded && e.Code == CodeLimitExceeded
+}
+
+// newParseError creates an error spanning [offset, end) of the input; the position is resolved by locate once the
+// input is known.
+func newParseError(code ErrorCode, offset int, end int, hint string, format string, args ...any) *ParseError {
+	return &ParseError{Offset: offset, end: end, Code: code, Hint: hint, Msg: fmt.Sprintf(format, args...)}
+}
+
+func nodeError(code ErrorCode, n node, hint string, format string, args ...any) *ParseError {
+	return newParseError(code, n.Pos(), n.End(), hint, format, args...)
+}
+
+func (e *ParseError) locate(input string) {
+	e.Input = input
+	e.Line, e.Column = 1, 1
+	for i := 0; i < e.Offset && i < len(input); i++ {
+		if input[i] == '\n' {
+			e.Line++
+			e.Column = 1
+		} else if utf8.RuneStart(input[i]) {
+			e.Column++
+		}
+	}
+	switch {
+	case e.Offset >= len(input):
+		e.Token = "EOF"
+	case e.end > e.Offset && e.end <= len(input):
+		e.Token = input[e.Offset:e.end]
+	default:
+		e.Token = input[e.Offset:]
+	}
+}
+
+// locateError attaches the input to a ParseError, wrapping any other error as one positioned at the start.
+func locateError(input string, err error) *ParseError {
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		pe = newParseError(CodeInvalidExpression, 0, len(input), "", "%s", err.Error())
+	}
+	pe.locate(input)
+	return pe
+}
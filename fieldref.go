@@ -0,0 +1,81 @@
+package mongoq
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// fieldRef is a reference to another field on the right side of a comparison, written as $name or field(name).
+type fieldRef struct {
+	name string
+	n    node
+}
+
+func (r *fieldRef) misplaced() error {
+	return nodeError(CodeInvalidOperand, r.n, "compare it with ==, !=, <, <=, > or >=", "field reference %s can only be compared with a field", r.name)
+}
+
+func callField(call *Call) (any, error) {
+	return &fieldRef{name: call.String(0), n: call.e.Args[0]}, nil
+}
+
+// compareFields builds the $expr for a comparison of the field on the left with the field referenced on the right,
+// e.g. temp > $threshold.
+func (c *converter) compareFields(operator string, lname string, right *fieldRef, e *binaryExpr) (bson.D, error) {
+	lpath, lf, err := c.resolveField(lname, e.X, operator)
+	if err != nil {
+		return nil, err
+	}
+	rpath, rf, err := c.resolveField(right.name, right.n, operator)
+	if err != nil {
+		return nil, err
+	}
+	if lf != nil && rf != nil && !comparableTypes(lf.Type, rf.Type) {
+		return nil, nodeError(CodeTypeMismatch, e, "", "cannot compare %s field %s with %s field %s", lf.Type, lname, rf.Type, right.name)
+	}
+	return bson.D{{Key: "$expr", Value: bson.D{{Key: operator, Value: []any{"$" + lpath, "$" + rpath}}}}}, nil
+}
+
+func comparableTypes(a FieldType, b FieldType) bool {
+	if a == TypeAny || b == TypeAny || a == b {
+		return true
+	}
+	return isNumericType(a) && isNumericType(b)
+}
+
+func isNumericType(t FieldType) bool {
+	switch t {
+	case TypeInt32, TypeInt64, TypeDouble, TypeDecimal, TypeNumber:
+		return true
+	}
+	return false
+}
+
+// exprComparison returns the operator and operands of an $expr comparison built by the parser.
+func exprComparison(expr any) (string, any, any, bool) {
+	doc, ok := asFilter(expr)
+	if !ok || len(doc) != 1 {
+		return "", nil, nil, false
+	}
+	for op, args := range doc {
+		if _, isCmp := comparisonOperators[op]; !isCmp {
+			return "", nil, nil, false
+		}
+		arr, ok := asArray(args)
+		if !ok || len(arr) != 2 {
+			return "", nil, nil, false
+		}
+		return op, arr[0], arr[1], true
+	}
+	return "", nil, nil, false
+}
+
+func isFieldPath(s string) bool {
+	return len(s) > 1 && s[0] == '$' && s[1] != '$'
+}
+
+// isFieldRefName reports whether an identifier written on either side of a comparison refers to a field, e.g. $name.
+func isFieldRefName(name string) bool {
+	return isFieldPath(name) && !strings.Contains(name[1:], "$")
+}
@@ -0,0 +1,92 @@
+package mongoq
+
+import (
+	"strings"
+)
+
+// FieldResolver maps a field name written in an expression to the path it is stored under.  It returns the name
+// unchanged if the field is not mapped, or an error to reject the field.
+type FieldResolver func(field string) (string, error)
+
+// WithFieldMap rewrites field names to the paths they are stored under, e.g. {"temp": "data.temperature_3303.0.value",
+// "customer": "tags.customer"}.  A mapping also applies to the paths below it, so customer.name becomes
+// tags.customer.name; the longest matching name wins.  A schema is checked against the names as written.
+func WithFieldMap(fields map[string]string) Option {
+	return func(p *Parser) {
+		p.fieldMap = make(map[string]string, len(fields))
+		for name, path := range fields {
+			p.fieldMap[name] = path
+		}
+	}
+}
+
+// WithFieldResolver sets a function that maps the field names the field map does not cover.
+func WithFieldResolver(fn FieldResolver) Option {
+	return func(p *Parser) {
+		p.fieldResolver = fn
+	}
+}
+
+func (p *Parser) mapField(name string) (string, error) {
+	prefix := name
+	for {
+		if path, found := p.fieldMap[prefix]; found {
+			return path + name[len(prefix):], nil
+		}
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	if p.fieldResolver != nil {
+		return p.fieldResolver(name)
+	}
+	return name, nil
+}
+
+// resolveField validates a reference to field with the given operator and returns the path it is stored under along
+// with its declaration, if there is a schema.
+// Inside elemMatch() the field is relative to the array elements: the schema and field map see the full path, and
+// the path returned is relative again.
+func (c *converter) resolveField(field string, n node, op string) (string, *Field, error) {
+	name := c.elemPath(field)
+	if err := checkFieldName(name, n); err != nil {
+		return "", nil, err
+	}
+	f, err := c.checkField(name, n, op)
+	if err != nil {
+		return "", nil, err
+	}
+	path, err := c.p.mapField(name)
+	if err != nil {
+		return "", nil, nodeError(CodeUnknownField, n, "", "%v", err)
+	}
+	if c.elem != "" {
+		elem, err := c.p.mapField(c.elem)
+		if err != nil || !strings.HasPrefix(path, elem+".") {
+			return "", nil, nodeError(CodeUnknownField, n, "", "field %s is not stored inside %s", name, c.elem)
+		}
+		path = path[len(elem)+1:]
+	}
+	return path, f, nil
+}
+
+// elemPath returns the full path of field, which is relative to the array elements inside elemMatch().
+func (c *converter) elemPath(field string) string {
+	if c.elem == "" {
+		return field
+	}
+	return c.elem + "." + field
+}
+
+// checkFieldName rejects names with a part starting with $, which MongoDB would read as an operator such as $where
+// rather than as a field.
+func checkFieldName(name string, n node) error {
+	for _, part := range strings.Split(name, ".") {
+		if strings.HasPrefix(part, "$") {
+			return nodeError(CodeInvalidOperand, n, "field names cannot start with $", "invalid field name: %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package mongoq
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Format renders a MongoDB filter as a mongoq expression.  It supports the filters ParseQuery produces, so that
+// ParseQuery(Format(q)) yields q again; terms are written in a canonical order.
+func Format(filter bson.M) (string, error) {
+	return formatFilter(filter)
+}
+
+var comparisonOperators = map[string]string{
+	"$eq":  "==",
+	"$ne":  "!=",
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+// sortedKeys returns the keys of filter with $and first, which keeps merged conditions grouped the way the parser
+// builds them.
+func sortedKeys(filter bson.M) []string {
+	keys := make([]string, 0, len(filter))
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == "$and") != (keys[j] == "$and") {
+			return keys[i] == "$and"
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func formatFilter(filter bson.M) (string, error) {
+	if len(filter) == 0 {
+		return "", fmt.Errorf("cannot format an empty filter")
+	}
+	var terms []string
+	for _, key := range sortedKeys(filter) {
+		value := filter[key]
+		var term string
+		var err error
+		switch key {
+		case "$and":
+			term, err = formatLogical(key, value, " && ")
+		case "$or":
+			term, err = formatLogical(key, value, " || ")
+			if err == nil && len(filter) > 1 {
+				term = "(" + term + ")"
+			}
+		case "$not":
+			sub, ok := asFilter(value)
+			if !ok {
+				return "", fmt.Errorf("$not needs a document")
+			}
+			term, err = formatFilter(sub)
+			term = "!(" + term + ")"
+		case "$text":
+			term, err = formatText(value)
+		case "$expr":
+			term, err = formatExpr(value)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return "", fmt.Errorf("unsupported operator: %s", key)
+			}
+			term, err = formatField(key, value)
+		}
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " && "), nil
+}
+
+func formatLogical(op string, value any, sep string) (string, error) {
+	subs, ok := asArray(value)
+	if !ok || len(subs) == 0 {
+		return "", fmt.Errorf("%s needs a non-empty array", op)
+	}
+	var terms []string
+	for _, sub := range subs {
+		f, ok := asFilter(sub)
+		if !ok {
+			return "", fmt.Errorf("%s entries must be documents", op)
+		}
+		term, err := formatFilter(f)
+		if err != nil {
+			return "", err
+		}
+		// keep nested groups together, e.g. an $or inside an $or or merged conditions inside an $and
+		if len(f) > 1 || (op == "$and" && (f["$and"] != nil)) || f["$or"] != nil {
+			term = "(" + term + ")"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, sep), nil
+}
+
+func formatText(value any) (string, error) {
+	ops, ok := asFilter(value)
+	if !ok {
+		return "", fmt.Errorf("$text needs a document")
+	}
+	search, ok := ops["$search"].(string)
+	if !ok || len(ops) != 1 {
+		return "", fmt.Errorf("unsupported $text options")
+	}
+	return "search(" + quoteString(search) + ")", nil
+}
+
+// formatExpr supports the $expr comparisons the parser produces for comparisons with arithmetic or another field.
+func formatExpr(value any) (string, error) {
+	op, left, right, ok := exprComparison(value)
+	if !ok {
+		return "", fmt.Errorf("unsupported $expr")
+	}
+	l, err := formatArithmetic(left, 0, false)
+	if err != nil {
+		return "", err
+	}
+	r, err := formatArithmetic(right, 0, true)
+	if err != nil {
+		return "", err
+	}
+	return l + " " + comparisonOperators[op] + " " + r, nil
+}
+
+// formatFieldRef renders a field on the right of a comparison, where a name alone would be read as a value.
+func formatFieldRef(field string) string {
+	r := "$" + field
+	if formatFieldName(field) != field || !isFieldRefName(r) {
+		return "field(" + quoteString(field) + ")"
+	}
+	return r
+}
+
+// formatArithmetic renders an aggregation expression built from $add, $subtract, $multiply, $divide and $mod, adding
+// parentheses where the operator binds more loosely than its parent.  Fields on the right of the comparison are
+// written as references.
+func formatArithmetic(v any, parentPrec int, right bool) (string, error) {
+	if path, ok := sizeField(v); ok {
+		return "size(" + formatFieldName(path) + ")", nil
+	}
+	if doc, ok := asFilter(v); ok && len(doc) == 1 {
+		for op, args := range doc {
+			if op == "$literal" {
+				return formatValue(args)
+			}
+			kind, found := arithmeticOperator(op)
+			if !found {
+				return "", fmt.Errorf("unsupported operator: %s", op)
+			}
+			arr, ok := asArray(args)
+			if !ok || len(arr) != 2 {
+				return "", fmt.Errorf("%s needs two operands", op)
+			}
+			prec := kind.precedence()
+			l, err := formatArithmetic(arr[0], prec, right)
+			if err != nil {
+				return "", err
+			}
+			r, err := formatArithmetic(arr[1], prec+1, right)
+			if err != nil {
+				return "", err
+			}
+			s := l + " " + kind.String() + " " + r
+			if prec < parentPrec {
+				s = "(" + s + ")"
+			}
+			return s, nil
+		}
+	}
+	if s, ok := v.(string); ok && isFieldPath(s) {
+		if right {
+			return formatFieldRef(s[1:]), nil
+		}
+		return formatFieldName(s[1:]), nil
+	}
+	return formatValue(v)
+}
+
+func formatField(field string, cond any) (string, error) {
+	name := formatFieldName(field)
+	ops, isOps := operatorDoc(cond)
+	if !isOps {
+		v, err := formatValue(cond)
+		if err != nil {
+			return "", err
+		}
+		return name + " == " + v, nil
+	}
+
+	opNames := make([]string, 0, len(ops))
+	for op := range ops {
+		opNames = append(opNames, op)
+	}
+	sort.Strings(opNames)
+
+	var terms []string
+	for _, op := range opNames {
+		arg := ops[op]
+		var term string
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			v, err := formatValue(arg)
+			if err != nil {
+				return "", err
+			}
+			term = name + " " + comparisonOperators[op] + " " + v
+		case "$in", "$nin", "$all":
+			v, err := formatList(op, arg)
+			if err != nil {
+				return "", err
+			}
+			term = name + " " + listOperators[op] + " " + v
+		case "$size":
+			v, err := formatValue(arg)
+			if err != nil {
+				return "", err
+			}
+			term = "size(" + name + ") == " + v
+		case "$not":
+			// only the negated $size the parser produces for size(name) != n
+			sub, ok := operatorDoc(arg)
+			if !ok || len(sub) != 1 || sub["$size"] == nil {
+				return "", fmt.Errorf("unsupported operator: %s", op)
+			}
+			v, err := formatValue(sub["$size"])
+			if err != nil {
+				return "", err
+			}
+			term = "size(" + name + ") != " + v
+		case "$type":
+			v, err := formatTypes(arg)
+			if err != nil {
+				return "", err
+			}
+			term = "isType(" + name + ", " + v + ")"
+		case "$elemMatch":
+			sub, ok := asFilter(arg)
+			if !ok {
+				return "", fmt.Errorf("$elemMatch needs a document")
+			}
+			cond, err := formatFilter(sub)
+			if err != nil {
+				return "", err
+			}
+			term = "elemMatch(" + name + ", " + cond + ")"
+		case "$exists":
+			if exists, _ := arg.(bool); exists {
+				term = "exists(" + name + ")"
+			} else {
+				term = "nexists(" + name + ")"
+			}
+		case "$regex":
+			re, err := regexFromOperator(ops, arg)
+			if err != nil {
+				return "", err
+			}
+			v, err := formatValue(re)
+			if err != nil {
+				return "", err
+			}
+			term = name + " == " + v
+		case "$options":
+			continue
+		default:
+			return "", fmt.Errorf("unsupported operator: %s", op)
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " && "), nil
+}
+
+var listOperators = map[string]string{"$in": "in", "$nin": "not in", "$all": "all"}
+
+func formatList(op string, value any) (string, error) {
+	list, ok := asArray(value)
+	if !ok {
+		return "", fmt.Errorf("%s needs an array", op)
+	}
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		v, err := formatValue(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, v)
+	}
+	return "[" + strings.Join(items, ", ") + "]", nil
+}
+
+func formatFieldName(field string) string {
+	l := newLexer(field)
+	tok := l.next()
+	if tok.kind == tokIdent && tok.lit == field && !isKeywordValue(field) {
+		if _, err := primitive.ObjectIDFromHex(field); err != nil {
+			return field
+		}
+	}
+	return quoteString(field)
+}
+
+func isKeywordValue(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "false", "null", "nil":
+		return true
+	}
+	return false
+}
+
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "null", nil
+	case string:
+		if needsVerbatim(v) {
+			return "str(" + quoteString(v) + ")", nil
+		}
+		return quoteString(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return formatFloat(v)
+	case float32:
+		return formatFloat(float64(v))
+	case primitive.Decimal128:
+		return v.String(), nil
+	case primitive.Binary:
+		return formatBinary(v)
+	case primitive.ObjectID:
+		h := v.Hex()
+		if strings.Trim(h, "0123456789") == "" {
+			return `"` + h + `"`, nil
+		}
+		return h, nil
+	case time.Time:
+		return `date("` + v.Format(time.RFC3339Nano) + `")`, nil
+	case primitive.DateTime:
+		return `date("` + v.Time().UTC().Format(time.RFC3339Nano) + `")`, nil
+	case primitive.Regex:
+		return formatRegex(v)
+	}
+	return "", fmt.Errorf("unsupported value: %v (%T)", value, value)
+}
+
+// formatRegex renders a regex literal, escaping slashes but copying escapes such as \\ as they are, which is how the
+// lexer reads them.  A pattern with \/, which would be read back as /, is written with regex() if its options allow.
+func formatRegex(re primitive.Regex) (string, error) {
+	for _, o := range re.Options {
+		if !strings.ContainsRune("imsx", o) {
+			return "", fmt.Errorf("unsupported regex option: %c", o)
+		}
+	}
+	var b strings.Builder
+	exact := true
+	for i := 0; i < len(re.Pattern); i++ {
+		c := re.Pattern[i]
+		switch {
+		case c == '\\' && i+1 == len(re.Pattern):
+			return "", fmt.Errorf("unsupported regex: %s ends with a backslash", re.Pattern)
+		case c == '\\':
+			exact = exact && re.Pattern[i+1] != '/'
+			b.WriteString(re.Pattern[i : i+2])
+			i++
+		case c == '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if !exact && re.Options == "i" {
+		return "regex(" + quoteString(re.Pattern) + ")", nil
+	}
+	return "/" + b.String() + "/" + re.Options, nil
+}
+
+// formatBinary writes UUIDs and generic binary data the way a schema declaring the field as TypeUUID or TypeBinary
+// reads them back.
+func formatBinary(b primitive.Binary) (string, error) {
+	switch b.Subtype {
+	case bson.TypeBinaryUUID:
+		if len(b.Data) != 16 {
+			return "", fmt.Errorf("invalid UUID: %x", b.Data)
+		}
+		h := hex.EncodeToString(b.Data)
+		return `"` + h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:] + `"`, nil
+	case bson.TypeBinaryGeneric:
+		return quoteString(base64.StdEncoding.EncodeToString(b.Data)), nil
+	}
+	return "", fmt.Errorf("unsupported binary subtype: %d", b.Subtype)
+}
+
+func formatFloat(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("unsupported value: %v", f)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s, nil
+}
+
+// quoteString quotes s for the lexer, which also ends a double-quoted string at a closing smart quote.
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, `”`, `\”`)
+	return `"` + s + `"`
+}
+
+// needsVerbatim reports whether a quoted string would be read back as something else, e.g. a wildcard or ObjectID.
+func needsVerbatim(s string) bool {
+	if _, err := primitive.ObjectIDFromHex(s); err == nil {
+		return true
+	}
+	if _, ok := isRegex(s); ok {
+		return true
+	}
+	return strings.Contains(s, "*")
+}
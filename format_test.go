@@ -0,0 +1,89 @@
+package mongoq
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testRoundTrip checks that formatting a parsed filter and parsing it again gives the same filter.
+func (s *ReportSuite) testRoundTrip(expr string, filter bson.M) {
+	formatted, err := Format(filter)
+	if !s.NoError(err, expr) {
+		return
+	}
+	reparsed, err := ParseQuery(formatted)
+	if s.NoError(err, "%s => %s", expr, formatted) {
+		s.Equal(filter, reparsed, "%s => %s", expr, formatted)
+	}
+}
+
+func (s *ReportSuite) TestFormat() {
+	oid, _ := primitive.ObjectIDFromHex("5fc4722ae367f19055977d1f")
+	price, _ := primitive.ParseDecimal128("19.99")
+	uuid := []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+	vectors := []struct {
+		f bson.M
+		e string
+		x string
+	}{
+		{f: bson.M{"name": "Alice", "age": bson.M{"$gte": int64(18)}}, e: `age >= 18 && name == "Alice"`},
+		{f: bson.M{"$or": []any{bson.M{"a": int64(1)}, bson.M{"b": 2.0}}, "c": true}, e: `(a == 1 || b == 2.0) && c == true`},
+		{f: bson.M{"name": bson.M{"$nin": []any{"Alice", "Bob"}}}, e: `name not in ["Alice", "Bob"]`},
+		{f: bson.M{"tags": bson.M{"$all": []any{"a", "b"}}}, e: `tags all ["a", "b"]`},
+		{f: bson.M{"ids": bson.M{"$in": []any{int64(-1), "x", oid}}, "none": bson.M{"$nin": []any{}}}, e: `ids in [-1, "x", 5fc4722ae367f19055977d1f] && none not in []`},
+		{f: bson.M{"name": bson.M{"$exists": false}, "desc": bson.M{"$exists": true}}, e: `exists(desc) && nexists(name)`},
+		{f: bson.M{"name": primitive.Regex{Pattern: "^a/b", Options: "i"}}, e: `name == /^a\/b/i`},
+		{f: bson.M{"name": bson.M{"$regex": "^a", "$options": "m"}}, e: `name == /^a/m`},
+		{f: bson.M{"n": primitive.Regex{Pattern: `a\\`}, "m": primitive.Regex{Pattern: `a\\/b`, Options: "s"}}, e: `m == /a\\\/b/s && n == /a\\/`},
+		{f: bson.M{"n": primitive.Regex{Pattern: `a\/b`, Options: "i"}}, e: `n == regex("a\\/b")`},
+		{f: bson.M{"n": primitive.Regex{Pattern: `a\`}}, x: `unsupported regex: a\ ends with a backslash`},
+		{f: bson.M{"_id": oid}, e: `_id == 5fc4722ae367f19055977d1f`},
+		{f: bson.M{"serial": "5fc4722ae367f19055977d1f", "glob": "a*"}, e: `glob == str("a*") && serial == str("5fc4722ae367f19055977d1f")`},
+		{f: bson.M{"ts": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}, e: `ts == date("2020-12-01T00:00:00Z")`},
+		{f: bson.M{"price": bson.M{"$lt": price}, "count": int32(3)}, e: `count == 3 && price < 19.99`},
+		{f: bson.M{"uuid": primitive.Binary{Subtype: 4, Data: uuid}, "blob": primitive.Binary{Data: []byte{1, 2, 3}}}, e: `blob == "AQID" && uuid == "123e4567-e89b-12d3-a456-426614174000"`},
+		{f: bson.M{"$text": bson.M{"$search": "bob -joe"}}, e: `search("bob -joe")`},
+		{f: bson.M{"$not": bson.M{"a": int64(1), "b": int64(2)}}, e: `!(a == 1 && b == 2)`},
+		{f: bson.M{"type": "x", "true": "y", "a b": `q"uote\`}, e: `"a b" == "q\"uote\\" && "true" == "y" && type == "x"`},
+		{f: bson.M{"said": "“hi”", "it’s": "”"}, e: `"it’s" == "\”" && said == "“hi\”"`},
+		{f: bson.M{"$and": []any{bson.M{"age": bson.M{"$gt": int64(10)}}, bson.M{"age": bson.M{"$lt": int64(20)}}}, "z": int64(1)}, e: `age > 10 && age < 20 && z == 1`},
+		{f: bson.M{"readings": bson.M{"$elemMatch": bson.M{"type": "temp", "value": bson.M{"$gt": int64(50)}}}}, e: `elemMatch(readings, type == "temp" && value > 50)`},
+		{f: bson.M{"tags": bson.M{"$size": int64(3)}, "ids": bson.M{"$not": bson.M{"$size": int64(0)}}}, e: `size(ids) != 0 && size(tags) == 3`},
+		{f: bson.M{"$expr": bson.M{"$gte": []any{sizeExpr("$a b"), int64(2)}}}, e: `size("a b") >= 2`},
+		{f: bson.M{"owner": nil, "null": bson.M{"$ne": nil}}, e: `"null" != null && owner == null`},
+		{f: bson.M{"v": bson.M{"$type": "number"}, "w": bson.M{"$type": []any{"string", "array"}}}, e: `isType(v, "number") && isType(w, "string", "array")`},
+		{f: bson.M{"$where": "1"}, x: "unsupported operator: $where"},
+		{f: bson.M{"a": bson.M{"b": int64(1)}}, x: "unsupported value: map[b:1] (primitive.M)"},
+		{f: bson.M{}, x: "cannot format an empty filter"},
+	}
+	for _, v := range vectors {
+		formatted, err := Format(v.f)
+		if v.x != "" {
+			s.EqualError(err, v.x)
+			continue
+		}
+		s.NoError(err)
+		s.Equal(v.e, formatted)
+
+		// the canonical form is stable
+		reparsed, err := ParseQuery(formatted)
+		s.Require().NoError(err, formatted)
+		again, err := Format(reparsed)
+		s.NoError(err)
+		s.Equal(formatted, again)
+	}
+
+	// quotes in values survive formatting, including the smart quotes that also end a string
+	s.testRoundTrip("quotes", bson.M{"a": `"”“'\`, "b”": "“x”"})
+
+	// backslashes in regexes, including the output of regex("a\\\\")
+	for _, pattern := range []string{`a\\`, `a\\/b`, `\\\\`, `a\/b`, `\d+/\.`} {
+		s.testRoundTrip(pattern, bson.M{"n": primitive.Regex{Pattern: pattern, Options: "i"}})
+	}
+	rslt, err := ParseQuery(`n == regex("a\\\\")`)
+	s.NoError(err)
+	s.Equal(bson.M{"n": primitive.Regex{Pattern: `a\\`, Options: "i"}}, rslt)
+	s.testRoundTrip("regex", rslt)
+}
@@ -0,0 +1,406 @@
+package mongoq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qwerty-iot/tox"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ArgType is the kind of value a function argument accepts.
+type ArgType int
+
+const (
+	ArgAny    ArgType = iota // any literal, bare word or function call, converted as the right side of a comparison would be
+	ArgString                // a string; bare words and numbers are accepted as their text
+	ArgField                 // a field path, quoted or not
+	ArgInt                   // an integer, passed as int64
+	ArgNumber                // an integer or float, passed as int64 or float64
+	ArgBool                  // true or false
+	// ArgCondition is a condition such as type == temp, passed as a bson.D filter.  Its fields are relative to the
+	// preceding ArgField argument, if there is one, as the condition applies to the elements of that array.
+	ArgCondition
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ArgString:
+		return "string"
+	case ArgField:
+		return "field"
+	case ArgInt:
+		return "integer"
+	case ArgNumber:
+		return "number"
+	case ArgBool:
+		return "boolean"
+	case ArgCondition:
+		return "condition"
+	}
+	return "value"
+}
+
+// ArgSpec describes one argument of a Function.
+type ArgSpec struct {
+	Name     string
+	Type     ArgType
+	Optional bool // optional arguments must come last
+}
+
+// Function describes a function that can be called from an expression, e.g. tag("customer", "ARAMARK").  Call
+// receives the arguments already checked and converted according to Args and returns a bson fragment such as a
+// bson.M or bson.D condition, or a value to compare against.
+type Function struct {
+	Name     string
+	Args     []ArgSpec
+	Variadic bool // the last argument may be repeated
+	// Volatile marks functions whose result changes over time, such as dateRelative(); a CompiledQuery calls them
+	// again each time it is rendered instead of keeping the result from when it was compiled.
+	Volatile bool
+	Call     func(call *Call) (any, error)
+}
+
+// Call is a single invocation of a Function.
+type Call struct {
+	Name     string
+	Args     []any  // one value per argument supplied, typed according to the ArgSpec
+	ParentOp string // operator the call is an operand of, e.g. "==" or "&&", or "" at the top level
+	Parser   *Parser
+
+	c *converter
+	e *callExpr
+}
+
+// ArgError returns a ParseError positioned at argument i, or at the whole call if i is out of range.
+func (call *Call) ArgError(i int, hint string, format string, args ...any) error {
+	if i >= 0 && i < len(call.e.Args) {
+		return nodeError(CodeInvalidArgument, call.e.Args[i], hint, format, args...)
+	}
+	return nodeError(CodeInvalidArgument, call.e, hint, format, args...)
+}
+
+// String returns argument i as a string, or "" if it was not supplied.
+func (call *Call) String(i int) string {
+	if i < len(call.Args) {
+		return tox.ToString(call.Args[i])
+	}
+	return ""
+}
+
+// Field returns argument i as the path of a field used with op, e.g. "$exists".  The field is checked against the
+// parser's schema and rewritten by its field map.
+func (call *Call) Field(i int, op string) (string, error) {
+	var n node = call.e
+	if i >= 0 && i < len(call.e.Args) {
+		n = call.e.Args[i]
+	}
+	path, _, err := call.c.resolveField(call.String(i), n, op)
+	return path, err
+}
+
+// Now returns the time the expression is evaluated at: the time of the parser's clock when the expression is
+// converted, or the time given to CompiledQuery.RenderAt.  It is the same for every call in an expression.  Functions
+// using it should be Volatile.
+func (call *Call) Now() time.Time {
+	if call.c.now.IsZero() {
+		call.c.now = call.Parser.now()
+	}
+	return call.c.now
+}
+
+// Strings returns all arguments from i onwards as strings.
+func (call *Call) Strings(i int) []string {
+	var arr []string
+	for ; i < len(call.Args); i++ {
+		arr = append(arr, tox.ToString(call.Args[i]))
+	}
+	return arr
+}
+
+func (fn *Function) validate() error {
+	if fn.Name == "" || !isIdentStart(rune(fn.Name[0])) {
+		return fmt.Errorf("invalid function name: %q", fn.Name)
+	}
+	if fn.Call == nil {
+		return fmt.Errorf("function %s has no implementation", fn.Name)
+	}
+	optional := false
+	for _, arg := range fn.Args {
+		if optional && !arg.Optional {
+			return fmt.Errorf("function %s: required argument %s follows an optional one", fn.Name, arg.Name)
+		}
+		optional = arg.Optional
+	}
+	return nil
+}
+
+// minArgs returns the number of required arguments.
+func (fn *Function) minArgs() int {
+	n := 0
+	for _, arg := range fn.Args {
+		if !arg.Optional {
+			n++
+		}
+	}
+	return n
+}
+
+// argSpec returns the spec for argument i, or false if the function does not accept that many.
+func (fn *Function) argSpec(i int) (ArgSpec, bool) {
+	if i < len(fn.Args) {
+		return fn.Args[i], true
+	}
+	if fn.Variadic && len(fn.Args) > 0 {
+		return fn.Args[len(fn.Args)-1], true
+	}
+	return ArgSpec{}, false
+}
+
+// registry is a concurrency-safe set of functions.
+type registry struct {
+	mutex     sync.RWMutex
+	functions map[string]*Function
+}
+
+func newRegistry(from *registry) *registry {
+	r := &registry{functions: map[string]*Function{}}
+	if from != nil {
+		from.mutex.RLock()
+		for name, fn := range from.functions {
+			r.functions[name] = fn
+		}
+		from.mutex.RUnlock()
+	}
+	return r
+}
+
+func (r *registry) register(fn Function) error {
+	if err := fn.validate(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.functions[fn.Name] = &fn
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *registry) lookup(name string) (*Function, bool) {
+	r.mutex.RLock()
+	fn, found := r.functions[name]
+	r.mutex.RUnlock()
+	return fn, found
+}
+
+func (r *registry) names() []string {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.functions))
+	for name := range r.functions {
+		names = append(names, name)
+	}
+	r.mutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// defaultFunctions holds the builtins and anything added with RegisterFunction; new parsers start with a copy.
+var defaultFunctions = builtinFunctions()
+
+// RegisterFunction adds fn to the default registry, making it available to ParseQuery and to parsers created
+// afterwards.  A function with the same name is replaced.
+func RegisterFunction(fn Function) error {
+	if err := defaultFunctions.register(fn); err != nil {
+		return err
+	}
+	if err := defaultParser.functions.register(fn); err != nil {
+		return err
+	}
+	defaultParser.cache.purge()
+	return nil
+}
+
+// RegisterFunction adds fn to this parser only.  A function with the same name is replaced.
+func (p *Parser) RegisterFunction(fn Function) error {
+	if err := p.functions.register(fn); err != nil {
+		return err
+	}
+	p.cache.purge()
+	return nil
+}
+
+// WithFunctions registers additional functions on the parser.  Invalid functions are ignored; use
+// Parser.RegisterFunction to receive the error.
+func WithFunctions(fns ...Function) Option {
+	return func(p *Parser) {
+		for _, fn := range fns {
+			_ = p.functions.register(fn)
+		}
+	}
+}
+
+func (c *converter) convertCallArgs(fn *Function, e *callExpr) ([]any, error) {
+	if len(e.Args) < fn.minArgs() {
+		return nil, nodeError(CodeInvalidArgument, e, "", "%s() expected %d arguments, got %d", fn.Name, fn.minArgs(), len(e.Args))
+	}
+	args := make([]any, 0, len(e.Args))
+	elem, field := c.elem, ""
+	for i, arg := range e.Args {
+		spec, ok := fn.argSpec(i)
+		if !ok {
+			return nil, nodeError(CodeInvalidArgument, arg, "", "%s() expected at most %d arguments, got %d", fn.Name, len(fn.Args), len(e.Args))
+		}
+		if spec.Type == ArgCondition && field != "" {
+			c.elem = c.elemPath(field)
+		}
+		value, err := c.convertCallArg(fn, spec, arg)
+		c.elem = elem
+		if err != nil {
+			return nil, err
+		}
+		if spec.Type == ArgField {
+			field = tox.ToString(value)
+		}
+		args = append(args, value)
+	}
+	return args, nil
+}
+
+func (c *converter) convertCallArg(fn *Function, spec ArgSpec, arg node) (any, error) {
+	argErr := func() error {
+		name := spec.Name
+		if name == "" {
+			name = "argument"
+		}
+		return nodeError(CodeInvalidArgument, arg, "", "%s() %s must be of type %s", fn.Name, name, spec.Type)
+	}
+	if spec.Type == ArgCondition {
+		cond, err := c.convertExprToMongoQuery(arg, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cond.(bson.D); !ok {
+			return nil, argErr()
+		}
+		return cond, nil
+	}
+	switch targ := arg.(type) {
+	case *basicLit:
+		switch spec.Type {
+		case ArgString, ArgField:
+			if targ.Kind == tokRegex {
+				return nil, argErr()
+			}
+			return targ.Value, nil
+		case ArgInt:
+			if targ.Kind != tokInt {
+				return nil, argErr()
+			}
+			return tox.ToInt64(targ.Value), nil
+		case ArgNumber:
+			if targ.Kind == tokInt {
+				return tox.ToInt64(targ.Value), nil
+			} else if targ.Kind == tokFloat {
+				return tox.ToFloat64(targ.Value), nil
+			}
+			return nil, argErr()
+		case ArgBool:
+			return nil, argErr()
+		}
+		op := tokComma
+		return c.convertLiteralOp(targ, &op)
+	case *ident:
+		switch spec.Type {
+		case ArgString, ArgField:
+			return targ.Name, nil
+		case ArgBool:
+			v, err := c.convertIdentOp(targ, nil)
+			if _, ok := v.(bool); !ok || err != nil {
+				return nil, argErr()
+			}
+			return v, nil
+		case ArgInt, ArgNumber:
+			return nil, argErr()
+		}
+		op := tokComma
+		return c.convertIdentOp(targ, &op)
+	case *callExpr:
+		if spec.Type != ArgAny {
+			return nil, argErr()
+		}
+		op := tokComma
+		v, err := c.convertCallExpr(targ, &op)
+		if err != nil {
+			return nil, err
+		}
+		switch v.(type) {
+		case *fieldRef, *arraySize:
+			return nil, argErr()
+		}
+		return v, c.checkRegex(v, targ)
+	case *paramExpr:
+		if spec.Type == ArgField {
+			return nil, argErr()
+		}
+		op := tokComma
+		v, err := c.convertParam(targ, &op)
+		if err != nil {
+			return nil, err
+		}
+		switch tv := v.(type) {
+		case string:
+			if spec.Type == ArgString || spec.Type == ArgAny {
+				return tv, nil
+			}
+		case int64:
+			if spec.Type == ArgInt || spec.Type == ArgNumber || spec.Type == ArgAny {
+				return tv, nil
+			}
+		case float64:
+			if spec.Type == ArgNumber || spec.Type == ArgAny {
+				return tv, nil
+			}
+		case bool:
+			if spec.Type == ArgBool || spec.Type == ArgAny {
+				return tv, nil
+			}
+		default:
+			if spec.Type == ArgAny {
+				return tv, nil
+			}
+		}
+		return nil, argErr()
+	}
+	return nil, nodeError(CodeInvalidArgument, arg, "use a field name or a literal value", "%s() unsupported argument type", fn.Name)
+}
+
+func (c *converter) convertCallExpr(e *callExpr, parentOp *tokenKind) (any, error) {
+	fn, found := c.p.functions.lookup(e.Fun.Name)
+	if !found {
+		return nil, nodeError(CodeUnsupportedFunction, e.Fun, "available functions: "+strings.Join(c.p.functions.names(), ", "), "unsupported function: %s", e.Fun.Name)
+	}
+	target := c.target
+	c.target = nil
+	args, err := c.convertCallArgs(fn, e)
+	c.target = target
+	if err != nil {
+		return nil, err
+	}
+	call := &Call{Name: fn.Name, Args: args, Parser: c.p, c: c, e: e}
+	if parentOp != nil {
+		call.ParentOp = parentOp.String()
+	}
+	if fn.Volatile {
+		c.volatile = true
+	}
+	rslt, err := fn.Call(call)
+	if err != nil {
+		if _, ok := err.(*ParseError); !ok {
+			err = nodeError(CodeInvalidArgument, e, "", "%s() %s", fn.Name, err.Error())
+		}
+		return nil, err
+	}
+	return toDocument(rslt), nil
+}
@@ -0,0 +1,355 @@
+package mongoq
+
+import "strings"
+
+// node is an element of the query AST produced by the grammar.  Pos and End are byte offsets into the input.
+type node interface {
+	Pos() int
+	End() int
+}
+
+type binaryExpr struct {
+	Op    tokenKind
+	OpPos int
+	OpEnd int
+	X     node
+	Y     node
+}
+
+type unaryExpr struct {
+	Op    tokenKind
+	OpPos int
+	X     node
+}
+
+type parenExpr struct {
+	Lparen int
+	X      node
+	Rparen int
+}
+
+type basicLit struct {
+	Kind     tokenKind // tokInt, tokFloat, tokString or tokRegex
+	ValuePos int
+	ValueEnd int
+	Value    string
+	Options  string
+}
+
+type ident struct {
+	NamePos int
+	NameEnd int
+	Name    string // readings[0] is written as readings.0
+}
+
+type callExpr struct {
+	Fun    *ident
+	Lparen int
+	Args   []node
+	Rparen int
+}
+
+type paramExpr struct {
+	ParamPos int
+	Name     string // name of a :name placeholder, "" for ?
+	Index    int    // position of a ? placeholder among the others
+	List     bool   // the list of in, not in, all or any, bound to a slice
+}
+
+type listExpr struct {
+	Lbrack int
+	Elems  []node
+	Rbrack int
+}
+
+// rangeExpr is the range of in, e.g. 18..65, from Low included to High excluded.
+type rangeExpr struct {
+	Low   node
+	OpPos int
+	High  node
+}
+
+func (e *binaryExpr) Pos() int { return e.X.Pos() }
+func (e *unaryExpr) Pos() int  { return e.OpPos }
+func (e *parenExpr) Pos() int  { return e.Lparen }
+func (e *basicLit) Pos() int   { return e.ValuePos }
+func (e *ident) Pos() int      { return e.NamePos }
+func (e *callExpr) Pos() int   { return e.Fun.NamePos }
+func (e *listExpr) Pos() int   { return e.Lbrack }
+func (e *paramExpr) Pos() int  { return e.ParamPos }
+func (e *rangeExpr) Pos() int  { return e.Low.Pos() }
+
+func (e *binaryExpr) End() int { return e.Y.End() }
+func (e *unaryExpr) End() int  { return e.X.End() }
+func (e *parenExpr) End() int  { return e.Rparen + 1 }
+func (e *basicLit) End() int   { return e.ValueEnd }
+func (e *ident) End() int      { return e.NameEnd }
+func (e *callExpr) End() int   { return e.Rparen + 1 }
+func (e *listExpr) End() int   { return e.Rbrack + 1 }
+func (e *paramExpr) End() int  { return e.ParamPos + 1 + len(e.Name) }
+func (e *rangeExpr) End() int  { return e.High.End() }
+
+// maxDepth is the nesting depth allowed whatever the Limits, as deeper expressions would overflow the stack.
+const maxDepth = 10000
+
+// grammar is a recursive-descent parser for the mongoq expression language:
+//
+//	expr    = unary { binop unary | listop list | "in" range }
+//	list    = "[" [ unary { "," unary } ] "]" | param
+//	range   = unary ".." unary
+//	unary   = ( "!" | "-" | "+" ) unary | primary
+//	primary = ident [ "(" [ expr { "," expr } ] ")" ] | int | float | string | regex | param | "(" expr ")"
+type grammar struct {
+	lex    *lexer
+	input  string
+	tok    token
+	limits Limits
+	depth  int
+	joins  int // number of && and || operators, one less than the number of clauses
+	params int // number of ? placeholders
+}
+
+func parseExpr(input string, limits Limits) (node, error) {
+	g := &grammar{lex: newLexer(input), input: input, limits: limits}
+	g.next()
+	expr, err := g.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if g.tok.kind != tokEOF {
+		return nil, g.errorf(g.tok, "combine conditions with && or ||", "expected 'EOF', found %s", g.tok)
+	}
+	return expr, nil
+}
+
+func (g *grammar) next() {
+	g.tok = g.lex.next()
+}
+
+func (g *grammar) errorf(tok token, hint string, format string, args ...any) error {
+	return newParseError(CodeSyntax, tok.pos, tok.end, hint, format, args...)
+}
+
+func (g *grammar) expect(kind tokenKind) (token, error) {
+	tok := g.tok
+	if tok.kind != kind {
+		return tok, g.errorf(tok, "", "expected '%s', found %s", kind, tok)
+	}
+	g.next()
+	return tok, nil
+}
+
+func (g *grammar) parseBinary(minPrec int) (node, error) {
+	x, err := g.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := g.tok
+		prec := op.kind.precedence()
+		if prec < minPrec {
+			return x, nil
+		}
+		if op.kind == tokLAnd || op.kind == tokLOr {
+			g.joins++
+			if g.limits.MaxClauses > 0 && g.joins >= g.limits.MaxClauses {
+				return nil, newParseError(CodeLimitExceeded, op.pos, op.end, "simplify the expression", "expression has more than %d clauses", g.limits.MaxClauses)
+			}
+		}
+		g.next()
+		var y node
+		if isListOp(op.kind) {
+			y, err = g.parseList(op)
+		} else {
+			y, err = g.parseBinary(prec + 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{Op: op.kind, OpPos: op.pos, OpEnd: op.end, X: x, Y: y}
+	}
+}
+
+func (g *grammar) parseUnary() (node, error) {
+	// nesting of parentheses, negations and function arguments all pass through here
+	g.depth++
+	defer func() { g.depth-- }()
+	limit := g.limits.MaxDepth
+	if limit <= 0 || limit > maxDepth {
+		limit = maxDepth
+	}
+	if g.depth > limit {
+		return nil, newParseError(CodeLimitExceeded, g.tok.pos, g.tok.end, "simplify the expression", "expression nested deeper than %d levels", limit)
+	}
+	if g.tok.kind == tokNot || g.tok.kind == tokSub || g.tok.kind == tokAdd {
+		op := g.tok
+		g.next()
+		if op.kind != tokNot {
+			if lit := g.parseSigned(op); lit != nil {
+				return lit, nil
+			}
+		}
+		x, err := g.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op.kind == tokAdd {
+			return x, nil
+		}
+		return &unaryExpr{Op: op.kind, OpPos: op.pos, X: x}, nil
+	}
+	return g.parsePrimary()
+}
+
+// parseSigned reads a number following a sign as a single literal, so that -5 can be used wherever 5 can, e.g. in
+// lists and function arguments.  A word starting with a digit directly after the sign, such as -15m, or an ISO 8601
+// duration such as -P1D, is read as one identifier.
+func (g *grammar) parseSigned(sign token) node {
+	tok := g.tok
+	prefix := ""
+	if sign.kind == tokSub {
+		prefix = "-"
+	}
+	switch {
+	case tok.kind == tokInt || tok.kind == tokFloat:
+		g.next()
+		return &basicLit{Kind: tok.kind, ValuePos: sign.pos, ValueEnd: tok.end, Value: prefix + tok.lit}
+	case tok.kind == tokIdent && tok.pos == sign.end && (isDigit(tok.lit[0]) || isISODurationStart(tok.lit)):
+		g.next()
+		return &ident{NamePos: tok.pos - len(prefix), NameEnd: tok.end, Name: prefix + tok.lit}
+	}
+	return nil
+}
+
+func isISODurationStart(lit string) bool {
+	return len(lit) > 1 && lit[0] == 'P' && (isDigit(lit[1]) || lit[1] == 'T')
+}
+
+func (g *grammar) parsePrimary() (node, error) {
+	tok := g.tok
+	switch tok.kind {
+	case tokIdent:
+		g.next()
+		id := &ident{NamePos: tok.pos, NameEnd: tok.end, Name: tok.lit}
+		if g.tok.kind == tokLParen {
+			return g.parseCall(id)
+		}
+		return id, nil
+	case tokInt, tokFloat, tokString, tokRegex:
+		g.next()
+		return &basicLit{Kind: tok.kind, ValuePos: tok.pos, ValueEnd: tok.end, Value: tok.lit, Options: tok.opts}, nil
+	case tokLParen:
+		g.next()
+		x, err := g.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		rparen, err := g.expect(tokRParen)
+		if err != nil {
+			return nil, err
+		}
+		return &parenExpr{Lparen: tok.pos, X: x, Rparen: rparen.pos}, nil
+	case tokParam:
+		g.next()
+		param := &paramExpr{ParamPos: tok.pos, Name: strings.TrimPrefix(tok.lit, ":")}
+		if tok.lit == "?" {
+			param.Name, param.Index = "", g.params
+			g.params++
+		}
+		return param, nil
+	case tokLBrack:
+		return nil, g.errorf(tok, "write name in [...], name not in [...], name all [...] or name any [...]", "list without in, not in, all or any")
+	case tokIllegal:
+		if g.lex.err != nil {
+			return nil, g.lex.err
+		}
+	}
+	return nil, g.errorf(tok, "a field name, value, function call or '(' is expected here", "expected operand, found %s", tok)
+}
+
+func (g *grammar) parseCall(fun *ident) (node, error) {
+	lparen := g.tok.pos
+	g.next()
+	call := &callExpr{Fun: fun, Lparen: lparen}
+	for g.tok.kind != tokRParen {
+		arg, err := g.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if g.tok.kind != tokComma {
+			break
+		}
+		g.next()
+	}
+	rparen, err := g.expect(tokRParen)
+	if err != nil {
+		return nil, err
+	}
+	call.Rparen = rparen.pos
+	return call, nil
+}
+
+// parseList reads the list following in, not in, all or any.  Elements are single operands: values, signed numbers
+// and function calls.  A placeholder instead of the list is bound to a slice.
+func (g *grammar) parseList(op token) (node, error) {
+	if g.tok.kind != tokLBrack && op.kind == tokIn {
+		// a range, or a placeholder bound to a list
+		low, err := g.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if param, ok := low.(*paramExpr); ok && g.tok.kind != tokRange {
+			param.List = true
+			return param, nil
+		}
+		if g.tok.kind != tokRange {
+			return nil, newParseError(CodeSyntax, low.Pos(), low.End(), "write a list, e.g. name in [a, b], or a range, e.g. age in 18..65", "expected '[' after in, found %s", g.input[low.Pos():low.End()])
+		}
+		dots := g.tok
+		g.next()
+		high, err := g.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &rangeExpr{Low: low, OpPos: dots.pos, High: high}, nil
+	}
+	if g.tok.kind == tokParam {
+		param, err := g.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		param.(*paramExpr).List = true
+		return param, nil
+	}
+	lbrack, err := g.expect(tokLBrack)
+	if err != nil {
+		return nil, g.errorf(lbrack, "write the values in brackets, e.g. name "+op.kind.String()+" [a, b]", "expected '[' after %s, found %s", op.kind, lbrack)
+	}
+	list := &listExpr{Lbrack: lbrack.pos}
+	for g.tok.kind != tokRBrack {
+		elem, err := g.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		list.Elems = append(list.Elems, elem)
+		if g.tok.kind != tokComma {
+			break
+		}
+		g.next()
+	}
+	rbrack, err := g.expect(tokRBrack)
+	if err != nil {
+		return nil, g.errorf(rbrack, "separate values with ','", "expected ']', found %s", rbrack)
+	}
+	list.Rbrack = rbrack.pos
+	return list, nil
+}
+
+func isListOp(op tokenKind) bool {
+	switch op {
+	case tokIn, tokNotIn, tokAll, tokAny:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,523 @@
+package mongoq
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokIllegal tokenKind = iota
+	tokEOF
+
+	tokIdent  // name, person.age, 5fc4722ae367f19055977d1f
+	tokInt    // 123
+	tokFloat  // 1.5
+	tokString // "abc"
+	tokRegex  // /abc/i
+	tokParam  // ? and :name
+
+	tokLAnd // && and AND
+	tokLOr  // || or OR
+	tokAnd  // &
+	tokOr   // |
+	tokNot  // !
+
+	tokAdd // +
+	tokSub // -
+	tokMul // *
+	tokQuo // /
+	tokRem // %
+
+	tokEql // ==
+	tokNeq // !=
+	tokLss // <
+	tokGtr // >
+	tokLeq // <=
+	tokGeq // >=
+
+	tokIn    // in and IN
+	tokNotIn // not in and NOT IN
+	tokAll   // all and ALL
+	tokAny   // any and ANY
+
+	tokLParen // (
+	tokRParen // )
+	tokLBrack // [
+	tokRBrack // ]
+	tokComma  // ,
+	tokRange  // ..
+)
+
+var tokenNames = map[tokenKind]string{
+	tokIllegal: "ILLEGAL",
+	tokEOF:     "EOF",
+	tokIdent:   "IDENT",
+	tokInt:     "INT",
+	tokFloat:   "FLOAT",
+	tokString:  "STRING",
+	tokRegex:   "REGEX",
+	tokParam:   "PARAM",
+	tokLAnd:    "&&",
+	tokLOr:     "||",
+	tokAnd:     "&",
+	tokOr:      "|",
+	tokNot:     "!",
+	tokAdd:     "+",
+	tokSub:     "-",
+	tokMul:     "*",
+	tokQuo:     "/",
+	tokRem:     "%",
+	tokEql:     "==",
+	tokNeq:     "!=",
+	tokLss:     "<",
+	tokGtr:     ">",
+	tokLeq:     "<=",
+	tokGeq:     ">=",
+	tokIn:      "in",
+	tokNotIn:   "not in",
+	tokAll:     "all",
+	tokAny:     "any",
+	tokLParen:  "(",
+	tokRParen:  ")",
+	tokLBrack:  "[",
+	tokRBrack:  "]",
+	tokComma:   ",",
+	tokRange:   "..",
+}
+
+func (k tokenKind) String() string {
+	if s, found := tokenNames[k]; found {
+		return s
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// precedence returns the binary precedence of the token, or 0 if it is not a binary operator.  The levels mirror
+// Go's so that expressions written against the original go/parser implementation keep their meaning.
+func (k tokenKind) precedence() int {
+	switch k {
+	case tokLOr:
+		return 1
+	case tokLAnd:
+		return 2
+	case tokEql, tokNeq, tokLss, tokLeq, tokGtr, tokGeq, tokIn, tokNotIn, tokAll, tokAny:
+		return 3
+	case tokOr, tokAdd, tokSub:
+		return 4
+	case tokAnd, tokMul, tokQuo, tokRem:
+		return 5
+	}
+	return 0
+}
+
+type token struct {
+	kind tokenKind
+	pos  int    // byte offset into the input
+	end  int    // byte offset just past the token
+	lit  string // literal value; strings are unquoted and unescaped, regexes are the pattern
+	opts string // regex options
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "EOF"
+	case tokIdent, tokInt, tokFloat, tokParam:
+		return t.lit
+	case tokString:
+		return `"` + t.lit + `"`
+	case tokRegex:
+		return "/" + t.lit + "/" + t.opts
+	case tokIllegal:
+		return t.lit
+	}
+	return "'" + t.kind.String() + "'"
+}
+
+type lexer struct {
+	input  string
+	offset int
+	prev   tokenKind
+	err    *ParseError
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{input: input, prev: tokIllegal}
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func (l *lexer) peekRune(offset int) (rune, int) {
+	if offset >= len(l.input) {
+		return utf8.RuneError, 0
+	}
+	return utf8.DecodeRuneInString(l.input[offset:])
+}
+
+func (l *lexer) skipSpace() {
+	for l.offset < len(l.input) {
+		r, size := l.peekRune(l.offset)
+		if !unicode.IsSpace(r) {
+			return
+		}
+		l.offset += size
+	}
+}
+
+// operandEnded reports whether the previous token can end an operand, which decides if a '/' starts a regex literal.
+func (l *lexer) operandEnded() bool {
+	switch l.prev {
+	case tokIdent, tokInt, tokFloat, tokString, tokRegex, tokParam, tokRParen, tokRBrack:
+		return true
+	}
+	return false
+}
+
+func (l *lexer) next() token {
+	tok := l.scan()
+	tok.end = l.offset
+	l.prev = tok.kind
+	return tok
+}
+
+func (l *lexer) scan() token {
+	l.skipSpace()
+	start := l.offset
+	if start >= len(l.input) {
+		return token{kind: tokEOF, pos: start}
+	}
+
+	r, size := l.peekRune(start)
+	switch {
+	case r == '"' || r == '\'' || r == '“' || r == '”':
+		return l.scanString(r, size)
+	case r == '/' && !l.operandEnded():
+		return l.scanRegex()
+	case isDigit(l.input[start]):
+		return l.scanNumber()
+	case isIdentStart(r):
+		return l.scanIdent()
+	case r == '?' || r == ':':
+		return l.scanParam()
+	}
+
+	two := ""
+	if start+2 <= len(l.input) {
+		two = l.input[start : start+2]
+	}
+	switch two {
+	case "&&":
+		l.offset += 2
+		return token{kind: tokLAnd, pos: start, lit: two}
+	case "||":
+		l.offset += 2
+		return token{kind: tokLOr, pos: start, lit: two}
+	case "==":
+		l.offset += 2
+		return token{kind: tokEql, pos: start, lit: two}
+	case "!=":
+		l.offset += 2
+		return token{kind: tokNeq, pos: start, lit: two}
+	case "<=":
+		l.offset += 2
+		return token{kind: tokLeq, pos: start, lit: two}
+	case ">=":
+		l.offset += 2
+		return token{kind: tokGeq, pos: start, lit: two}
+	case "..":
+		l.offset += 2
+		return token{kind: tokRange, pos: start, lit: two}
+	}
+
+	l.offset += size
+	kind := tokIllegal
+	switch r {
+	case '&':
+		kind = tokAnd
+	case '|':
+		kind = tokOr
+	case '!':
+		kind = tokNot
+	case '+':
+		kind = tokAdd
+	case '-':
+		kind = tokSub
+	case '*':
+		kind = tokMul
+	case '/':
+		kind = tokQuo
+	case '%':
+		kind = tokRem
+	case '<':
+		kind = tokLss
+	case '>':
+		kind = tokGtr
+	case '(':
+		kind = tokLParen
+	case ')':
+		kind = tokRParen
+	case '[':
+		kind = tokLBrack
+	case ']':
+		kind = tokRBrack
+	case ',':
+		kind = tokComma
+	}
+	return token{kind: kind, pos: start, lit: string(r)}
+}
+
+func (l *lexer) scanIdent() token {
+	start := l.offset
+	lit := ""     // the path so far, with indexes written as segments
+	from := start // start of the input not yet copied to lit
+	for l.offset < len(l.input) {
+		r, size := l.peekRune(l.offset)
+		if isIdentPart(r) && (l.offset > from || from == start) {
+			l.offset += size
+			continue
+		}
+		// dotted paths are part of the identifier: person.age, readings.0.value
+		if r == '.' {
+			if nr, _ := l.peekRune(l.offset + 1); isIdentPart(nr) {
+				l.offset += size
+				continue
+			}
+		}
+		// and so are array indexes: readings[0].value is readings.0.value
+		if r == '[' && !l.isKeyword(lit+l.input[from:l.offset]) {
+			end := l.offset + 1
+			for end < len(l.input) && isDigit(l.input[end]) {
+				end++
+			}
+			if end > l.offset+1 && end < len(l.input) && l.input[end] == ']' {
+				lit += l.input[from:l.offset] + "." + l.input[l.offset+1:end]
+				l.offset = end + 1
+				from = l.offset
+				continue
+			}
+		}
+		break
+	}
+	lit += l.input[from:l.offset]
+	switch lit {
+	case "and", "AND":
+		return token{kind: tokLAnd, pos: start, lit: lit}
+	case "or", "OR":
+		return token{kind: tokLOr, pos: start, lit: lit}
+	}
+	// list operators are only keywords after an operand, so that fields and values may still be called in or all
+	if l.operandEnded() {
+		switch lit {
+		case "in", "IN":
+			return token{kind: tokIn, pos: start, lit: lit}
+		case "all", "ALL":
+			return token{kind: tokAll, pos: start, lit: lit}
+		case "any", "ANY":
+			return token{kind: tokAny, pos: start, lit: lit}
+		case "not", "NOT":
+			if l.scanIn() {
+				return token{kind: tokNotIn, pos: start, lit: l.input[start:l.offset]}
+			}
+		}
+	}
+	return token{kind: tokIdent, pos: start, lit: lit}
+}
+
+// isKeyword reports whether an identifier scanned at the current position would be an operator.
+func (l *lexer) isKeyword(lit string) bool {
+	switch lit {
+	case "and", "AND", "or", "OR":
+		return true
+	case "in", "IN", "all", "ALL", "any", "ANY", "not", "NOT":
+		return l.operandEnded()
+	}
+	return false
+}
+
+// scanIn consumes the in of not in, if it follows.
+func (l *lexer) scanIn() bool {
+	offset := l.offset
+	l.skipSpace()
+	if l.offset > offset && l.offset+2 <= len(l.input) {
+		if word := l.input[l.offset : l.offset+2]; word == "in" || word == "IN" {
+			if r, _ := l.peekRune(l.offset + 2); l.offset+2 == len(l.input) || !isIdentPart(r) {
+				l.offset += 2
+				return true
+			}
+		}
+	}
+	l.offset = offset
+	return false
+}
+
+func (l *lexer) scanNumber() token {
+	start := l.offset
+	for l.offset < len(l.input) && isDigit(l.input[l.offset]) {
+		l.offset++
+	}
+	// unquoted dates such as 2020-12-01 are words rather than subtractions
+	if end := l.dateEnd(start); end > 0 {
+		l.offset = end
+		for l.offset < len(l.input) {
+			r, size := l.peekRune(l.offset)
+			if !isIdentPart(r) {
+				break
+			}
+			l.offset += size
+		}
+		return token{kind: tokIdent, pos: start, lit: l.input[start:l.offset]}
+	}
+	kind := tokInt
+	if l.offset+1 < len(l.input) && l.input[l.offset] == '.' && isDigit(l.input[l.offset+1]) {
+		kind = tokFloat
+		l.offset++
+		for l.offset < len(l.input) && isDigit(l.input[l.offset]) {
+			l.offset++
+		}
+	}
+	if l.offset < len(l.input) && (l.input[l.offset] == 'e' || l.input[l.offset] == 'E') {
+		exp := l.offset + 1
+		if exp < len(l.input) && (l.input[exp] == '+' || l.input[exp] == '-') {
+			exp++
+		}
+		if exp < len(l.input) && isDigit(l.input[exp]) {
+			kind = tokFloat
+			l.offset = exp
+			for l.offset < len(l.input) && isDigit(l.input[l.offset]) {
+				l.offset++
+			}
+		}
+	}
+	// words that start with a digit, such as unquoted ObjectIDs or durations, are identifiers
+	if r, _ := l.peekRune(l.offset); l.offset < len(l.input) && isIdentPart(r) {
+		l.offset = start
+		for l.offset < len(l.input) {
+			r, size := l.peekRune(l.offset)
+			if !isIdentPart(r) {
+				break
+			}
+			l.offset += size
+		}
+		return token{kind: tokIdent, pos: start, lit: l.input[start:l.offset]}
+	}
+	return token{kind: kind, pos: start, lit: l.input[start:l.offset]}
+}
+
+// dateEnd returns the end of a date written year-month-day at start, such as 2020-12-01 or 2020-1-5, or 0 if there is
+// none.
+func (l *lexer) dateEnd(start int) int {
+	digits := func(from int, min int, max int) int {
+		end := from
+		for end < len(l.input) && end-from < max && isDigit(l.input[end]) {
+			end++
+		}
+		if end-from < min || (end < len(l.input) && isDigit(l.input[end])) {
+			return 0
+		}
+		return end
+	}
+	end := digits(start, 4, 4)
+	for i := 0; i < 2 && end > 0; i++ {
+		if end >= len(l.input) || l.input[end] != '-' {
+			return 0
+		}
+		end = digits(end+1, 1, 2)
+	}
+	return end
+}
+
+func (l *lexer) scanString(quote rune, size int) token {
+	start := l.offset
+	l.offset += size
+	closing := quote
+	if quote == '“' {
+		closing = '”'
+	}
+	var b strings.Builder
+	for l.offset < len(l.input) {
+		r, rsize := l.peekRune(l.offset)
+		if r == closing || (quote != '\'' && (r == '"' || r == '”')) {
+			l.offset += rsize
+			return token{kind: tokString, pos: start, lit: b.String()}
+		}
+		if r == '\\' {
+			// any quote that would end the string can be escaped
+			nr, nsize := l.peekRune(l.offset + rsize)
+			if nr == closing || nr == '\\' || (quote != '\'' && (nr == '"' || nr == '”')) {
+				b.WriteRune(nr)
+				l.offset += rsize + nsize
+				continue
+			}
+		}
+		b.WriteRune(r)
+		l.offset += rsize
+	}
+	l.err = newParseError(CodeSyntax, start, len(l.input), "add the closing quote", "string literal not terminated")
+	return token{kind: tokIllegal, pos: start, lit: l.input[start:]}
+}
+
+func (l *lexer) scanRegex() token {
+	start := l.offset
+	l.offset++
+	var b strings.Builder
+	for l.offset < len(l.input) {
+		c := l.input[l.offset]
+		if c == '/' {
+			l.offset++
+			optStart := l.offset
+			for l.offset < len(l.input) && strings.IndexByte("imsx", l.input[l.offset]) >= 0 {
+				l.offset++
+			}
+			return token{kind: tokRegex, pos: start, lit: b.String(), opts: l.input[optStart:l.offset]}
+		}
+		// \/ is a slash; other escapes, including \\, are copied into the pattern
+		if c == '\\' && l.offset+1 < len(l.input) {
+			if l.input[l.offset+1] == '/' {
+				b.WriteByte('/')
+			} else {
+				b.WriteString(l.input[l.offset : l.offset+2])
+			}
+			l.offset += 2
+			continue
+		}
+		b.WriteByte(c)
+		l.offset++
+	}
+	l.err = newParseError(CodeSyntax, start, len(l.input), "add the closing '/'", "regex literal not terminated")
+	return token{kind: tokIllegal, pos: start, lit: l.input[start:]}
+}
+
+// scanParam scans a positional placeholder, ?, or a named one such as :deviceId.
+func (l *lexer) scanParam() token {
+	start := l.offset
+	l.offset++
+	if l.input[start] == '?' {
+		return token{kind: tokParam, pos: start, lit: "?"}
+	}
+	for l.offset < len(l.input) {
+		r, size := l.peekRune(l.offset)
+		if !isIdentPart(r) || r == '$' {
+			break
+		}
+		l.offset += size
+	}
+	if l.offset == start+1 {
+		l.err = newParseError(CodeSyntax, start, l.offset, "name the placeholder, e.g. :deviceId", "placeholder without a name")
+		return token{kind: tokIllegal, pos: start, lit: ":"}
+	}
+	return token{kind: tokParam, pos: start, lit: l.input[start:l.offset]}
+}
@@ -0,0 +1,672 @@
+package mongoq
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Matcher evaluates a MongoDB filter against documents in memory, following MongoDB's matching semantics for the
+// operators ParseQuery generates.  A Matcher is safe for concurrent use.
+type Matcher struct {
+	filter  bson.M
+	regexes map[primitive.Regex]*regexp.Regexp
+}
+
+// NewMatcher parses expr with the default parser and returns a Matcher for it.
+func NewMatcher(expr string) (*Matcher, error) {
+	return defaultParser.Matcher(expr)
+}
+
+// Matcher parses expr and returns a Matcher for it.
+func (p *Parser) Matcher(expr string) (*Matcher, error) {
+	filter, err := p.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	return NewFilterMatcher(filter)
+}
+
+// NewFilterMatcher returns a Matcher for an existing filter.
+func NewFilterMatcher(filter bson.M) (*Matcher, error) {
+	m := &Matcher{filter: filter, regexes: map[primitive.Regex]*regexp.Regexp{}}
+	if err := m.compileRegexes(filter); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Filter returns the filter the Matcher evaluates.
+func (m *Matcher) Filter() bson.M {
+	return m.filter
+}
+
+// Match reports whether doc matches the filter.  doc may be a bson.M, bson.D, bson.Raw, map or a struct that can be
+// marshalled to BSON.
+func (m *Matcher) Match(doc any) (bool, error) {
+	d, err := normalizeDocument(doc)
+	if err != nil {
+		return false, err
+	}
+	return m.matchDocument(m.filter, d)
+}
+
+func normalizeDocument(doc any) (any, error) {
+	switch d := doc.(type) {
+	case bson.M, bson.D:
+		return d, nil
+	case map[string]any:
+		return bson.M(d), nil
+	case bson.Raw:
+		var m bson.M
+		if err := bson.Unmarshal(d, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case []byte:
+		return normalizeDocument(bson.Raw(d))
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeDocument(bson.Raw(raw))
+}
+
+func (m *Matcher) compileRegexes(v any) error {
+	switch tv := v.(type) {
+	case bson.M:
+		if pattern, found := tv["$regex"]; found {
+			re, err := regexFromOperator(tv, pattern)
+			if err != nil {
+				return err
+			}
+			return m.compileRegexes(re)
+		}
+		for _, sv := range tv {
+			if err := m.compileRegexes(sv); err != nil {
+				return err
+			}
+		}
+	case bson.D:
+		return m.compileRegexes(tv.Map())
+	case []any:
+		for _, sv := range tv {
+			if err := m.compileRegexes(sv); err != nil {
+				return err
+			}
+		}
+	case primitive.Regex:
+		if _, found := m.regexes[tv]; found {
+			return nil
+		}
+		flags := ""
+		for _, o := range tv.Options {
+			switch o {
+			case 'i', 'm', 's':
+				flags += string(o)
+			default:
+				return fmt.Errorf("unsupported regex option: %c", o)
+			}
+		}
+		pattern := tv.Pattern
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		m.regexes[tv] = re
+	}
+	return nil
+}
+
+func regexFromOperator(ops bson.M, pattern any) (primitive.Regex, error) {
+	switch p := pattern.(type) {
+	case primitive.Regex:
+		return p, nil
+	case string:
+		options, _ := ops["$options"].(string)
+		return primitive.Regex{Pattern: p, Options: options}, nil
+	}
+	return primitive.Regex{}, fmt.Errorf("$regex has to be a string")
+}
+
+func (m *Matcher) matchDocument(filter bson.M, doc any) (bool, error) {
+	for key, cond := range filter {
+		var ok bool
+		var err error
+		switch key {
+		case "$and", "$or", "$nor":
+			ok, err = m.matchLogical(key, cond, doc)
+		case "$not":
+			sub, isDoc := asFilter(cond)
+			if !isDoc {
+				return false, fmt.Errorf("$not needs a document")
+			}
+			ok, err = m.matchDocument(sub, doc)
+			ok = !ok
+		case "$expr":
+			ok, err = matchExpr(cond, doc)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("unsupported operator: %s", key)
+			}
+			ok, err = m.matchField(lookupPath(doc, strings.Split(key, ".")), cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchExpr evaluates the $expr comparisons the parser produces.  Like an aggregation expression, a field path that
+// passes through an array yields the array of values rather than each of them.
+func matchExpr(cond any, doc any) (bool, error) {
+	op, left, right, ok := exprComparison(cond)
+	if !ok {
+		return false, fmt.Errorf("unsupported $expr")
+	}
+	lv, err := evalExpr(left, doc)
+	if err != nil {
+		return false, err
+	}
+	rv, err := evalExpr(right, doc)
+	if err != nil {
+		return false, err
+	}
+	switch op {
+	case "$eq":
+		return valuesEqual(lv, rv), nil
+	case "$ne":
+		return !valuesEqual(lv, rv), nil
+	}
+	cmp, comparable := compareValues(lv, rv)
+	if !comparable {
+		return false, nil
+	}
+	switch op {
+	case "$gt":
+		return cmp > 0, nil
+	case "$gte":
+		return cmp >= 0, nil
+	case "$lt":
+		return cmp < 0, nil
+	}
+	return cmp <= 0, nil
+}
+
+// evalExpr evaluates an aggregation expression operand: a field path, a literal, the size of an array or arithmetic.  Arithmetic on a
+// missing or non-numeric value yields nil, as null does in MongoDB.
+func evalExpr(v any, doc any) (any, error) {
+	if s, ok := v.(string); ok && isFieldPath(s) {
+		return exprValue(doc, s[1:]), nil
+	}
+	if path, ok := sizeField(v); ok {
+		arr, _ := asArray(exprValue(doc, path))
+		return int32(len(arr)), nil
+	}
+	expr, ok := asFilter(v)
+	if !ok || len(expr) != 1 {
+		return v, nil
+	}
+	for op, args := range expr {
+		if op == "$literal" {
+			return args, nil
+		}
+		kind, found := arithmeticOperator(op)
+		if !found {
+			return nil, fmt.Errorf("unsupported operator: %s", op)
+		}
+		arr, ok := asArray(args)
+		if !ok || len(arr) != 2 {
+			return nil, fmt.Errorf("%s needs two operands", op)
+		}
+		l, err := evalExpr(arr[0], doc)
+		if err != nil {
+			return nil, err
+		}
+		r, err := evalExpr(arr[1], doc)
+		if err != nil {
+			return nil, err
+		}
+		return evalArithmetic(kind, l, r)
+	}
+	return v, nil
+}
+
+func evalArithmetic(op tokenKind, l any, r any) (any, error) {
+	if lt, ok := toTime(l); ok && (op == tokAdd || op == tokSub) {
+		if rt, ok := toTime(r); ok && op == tokSub {
+			return lt.Sub(rt).Milliseconds(), nil
+		}
+		if ms, ok := toFloat(r); ok {
+			if op == tokSub {
+				ms = -ms
+			}
+			return lt.Add(time.Duration(ms * float64(time.Millisecond))), nil
+		}
+		return nil, nil
+	}
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok {
+		return nil, nil
+	}
+	if isInteger(l) && isInteger(r) {
+		return applyArithmetic(op, int64(lf), int64(rf))
+	}
+	return applyArithmetic(op, lf, rf)
+}
+
+func isInteger(v any) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	}
+	return false
+}
+
+func exprValue(doc any, path string) any {
+	values := lookupPath(doc, strings.Split(path, "."))
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		return values[0]
+	}
+	return values
+}
+
+func (m *Matcher) matchLogical(op string, cond any, doc any) (bool, error) {
+	subs, ok := cond.([]any)
+	if !ok {
+		if a, isA := cond.(bson.A); isA {
+			subs = a
+		} else {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+	}
+	for _, sub := range subs {
+		f, isDoc := asFilter(sub)
+		if !isDoc {
+			return false, fmt.Errorf("%s entries must be documents", op)
+		}
+		matched, err := m.matchDocument(f, doc)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+func asFilter(v any) (bson.M, bool) {
+	switch tv := v.(type) {
+	case bson.M:
+		return tv, true
+	case bson.D:
+		return tv.Map(), true
+	case map[string]any:
+		return tv, true
+	}
+	return nil, false
+}
+
+// operatorDoc returns the condition as an operator document if every key starts with '$'.
+func operatorDoc(cond any) (bson.M, bool) {
+	ops, ok := asFilter(cond)
+	if !ok || len(ops) == 0 {
+		return nil, false
+	}
+	for k := range ops {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// lookupPath returns every value reached by path, traversing arrays the way MongoDB does: a path component is
+// applied to each document in an array, and a numeric component also indexes the array.
+func lookupPath(v any, parts []string) []any {
+	if len(parts) == 0 {
+		return []any{v}
+	}
+	switch tv := v.(type) {
+	case bson.M:
+		if child, found := tv[parts[0]]; found {
+			return lookupPath(child, parts[1:])
+		}
+	case map[string]any:
+		if child, found := tv[parts[0]]; found {
+			return lookupPath(child, parts[1:])
+		}
+	case bson.D:
+		for _, e := range tv {
+			if e.Key == parts[0] {
+				return lookupPath(e.Value, parts[1:])
+			}
+		}
+	case bson.A:
+		return lookupArray(tv, parts)
+	case []any:
+		return lookupArray(tv, parts)
+	}
+	return nil
+}
+
+func lookupArray(arr []any, parts []string) []any {
+	var rslt []any
+	if idx, err := strconv.Atoi(parts[0]); err == nil && idx >= 0 && idx < len(arr) {
+		rslt = append(rslt, lookupPath(arr[idx], parts[1:])...)
+	}
+	for _, elem := range arr {
+		if _, isDoc := asFilter(elem); isDoc {
+			rslt = append(rslt, lookupPath(elem, parts)...)
+		}
+	}
+	return rslt
+}
+
+func asArray(v any) ([]any, bool) {
+	switch tv := v.(type) {
+	case bson.A:
+		return tv, true
+	case []any:
+		return tv, true
+	}
+	return nil, false
+}
+
+// candidates expands array values so that operators match if the array or any of its elements matches.
+func candidates(values []any) []any {
+	var rslt []any
+	for _, v := range values {
+		rslt = append(rslt, v)
+		if arr, ok := asArray(v); ok {
+			rslt = append(rslt, arr...)
+		}
+	}
+	return rslt
+}
+
+func (m *Matcher) matchField(values []any, cond any) (bool, error) {
+	ops, isOps := operatorDoc(cond)
+	if !isOps {
+		return m.matchEq(values, cond), nil
+	}
+	for op, arg := range ops {
+		ok, err := m.matchOperator(values, op, arg, ops)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *Matcher) matchOperator(values []any, op string, arg any, ops bson.M) (bool, error) {
+	switch op {
+	case "$eq":
+		return m.matchEq(values, arg), nil
+	case "$ne":
+		return !m.matchEq(values, arg), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, v := range candidates(values) {
+			if cmp, ok := compareValues(v, arg); ok {
+				if (op == "$gt" && cmp > 0) || (op == "$gte" && cmp >= 0) || (op == "$lt" && cmp < 0) || (op == "$lte" && cmp <= 0) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$in", "$nin":
+		list, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		found := false
+		for _, item := range list {
+			if m.matchEq(values, item) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$all":
+		list, ok := asArray(arg)
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		if len(list) == 0 {
+			return false, nil
+		}
+		for _, item := range list {
+			if !m.matchEq(values, item) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$exists":
+		want, _ := arg.(bool)
+		return (len(values) > 0) == want, nil
+	case "$regex":
+		re, err := regexFromOperator(ops, arg)
+		if err != nil {
+			return false, err
+		}
+		return m.matchEq(values, re), nil
+	case "$options":
+		// handled with $regex
+		return true, nil
+	case "$size":
+		want, ok := toFloat(arg)
+		if !ok {
+			return false, fmt.Errorf("$size needs a number")
+		}
+		for _, v := range values {
+			if arr, isArr := asArray(v); isArr && float64(len(arr)) == want {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$type":
+		return matchType(values, arg)
+	case "$elemMatch":
+		sub, ok := asFilter(arg)
+		if !ok {
+			return false, fmt.Errorf("$elemMatch needs a document")
+		}
+		for _, v := range values {
+			arr, _ := asArray(v)
+			for _, elem := range arr {
+				if _, isDoc := asFilter(elem); !isDoc {
+					continue
+				}
+				if matched, err := m.matchDocument(sub, elem); err != nil || matched {
+					return matched, err
+				}
+			}
+		}
+		return false, nil
+	case "$not":
+		var ok bool
+		var err error
+		if re, isRe := arg.(primitive.Regex); isRe {
+			ok = m.matchEq(values, re)
+		} else {
+			ok, err = m.matchField(values, arg)
+		}
+		return !ok, err
+	}
+	return false, fmt.Errorf("unsupported operator: %s", op)
+}
+
+// matchEq reports whether any value, or any element of an array value, equals want.  A nil want also matches a
+// missing field.
+func (m *Matcher) matchEq(values []any, want any) bool {
+	if want == nil && len(values) == 0 {
+		return true
+	}
+	if re, ok := want.(primitive.Regex); ok {
+		compiled := m.regexes[re]
+		if compiled == nil {
+			return false
+		}
+		for _, v := range candidates(values) {
+			if s, isStr := v.(string); isStr && compiled.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range candidates(values) {
+		if valuesEqual(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func valuesEqual(a any, b any) bool {
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	if aa, ok := asArray(a); ok {
+		ba, ok := asArray(b)
+		if !ok || len(aa) != len(ba) {
+			return false
+		}
+		for i := range aa {
+			if !valuesEqual(aa[i], ba[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if am, ok := asFilter(a); ok {
+		bm, ok := asFilter(b)
+		if !ok || len(am) != len(bm) {
+			return false
+		}
+		for k, av := range am {
+			bv, found := bm[k]
+			if !found || !valuesEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch tv := v.(type) {
+	case int:
+		return float64(tv), true
+	case int8:
+		return float64(tv), true
+	case int16:
+		return float64(tv), true
+	case int32:
+		return float64(tv), true
+	case int64:
+		return float64(tv), true
+	case uint:
+		return float64(tv), true
+	case uint8:
+		return float64(tv), true
+	case uint16:
+		return float64(tv), true
+	case uint32:
+		return float64(tv), true
+	case uint64:
+		return float64(tv), true
+	case float32:
+		return float64(tv), true
+	case float64:
+		return tv, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(tv.String(), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toTime(v any) (time.Time, bool) {
+	switch tv := v.(type) {
+	case time.Time:
+		return tv, true
+	case primitive.DateTime:
+		return tv.Time(), true
+	}
+	return time.Time{}, false
+}
+
+// compareValues orders two values of the same BSON type class, returning false if they are not comparable.
+func compareValues(a any, b any) (int, bool) {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		if !ok || math.IsNaN(af) || math.IsNaN(bf) {
+			return 0, false
+		}
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+	if at, ok := toTime(a); ok {
+		bt, ok := toTime(b)
+		if !ok {
+			return 0, false
+		}
+		return at.Compare(bt), true
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case primitive.ObjectID:
+		if bv, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(av[:], bv[:]), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,173 @@
+package mongoq
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type matchVector struct {
+	e string
+	d bson.M
+	m bool
+}
+
+type sensorReading struct {
+	Type  string  `bson:"type"`
+	Value float64 `bson:"value"`
+}
+
+type device struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Name     string             `bson:"name"`
+	Age      int32              `bson:"age"`
+	Tags     []string           `bson:"tagArray"`
+	Readings []sensorReading    `bson:"readings"`
+	LastSeen time.Time          `bson:"lastSeen"`
+	Deleted  *bool              `bson:"deleted,omitempty"`
+}
+
+func (s *ReportSuite) testMatchVectors(vectors []matchVector) {
+	for _, vector := range vectors {
+		m, err := NewMatcher(vector.e)
+		s.Require().NoError(err, vector.e)
+
+		// the matcher evaluates exactly the filter ParseQuery produces
+		filter, err := ParseQuery(vector.e)
+		s.Require().NoError(err, vector.e)
+		s.Equal(filter, m.Filter(), vector.e)
+
+		matched, err := m.Match(vector.d)
+		s.NoError(err, vector.e)
+		s.Equal(vector.m, matched, vector.e)
+
+		raw, err := bson.Marshal(vector.d)
+		s.Require().NoError(err)
+		matched, err = m.Match(bson.Raw(raw))
+		s.NoError(err, vector.e)
+		s.Equal(vector.m, matched, "raw: "+vector.e)
+	}
+}
+
+func (s *ReportSuite) TestMatchQueries() {
+	oid, _ := primitive.ObjectIDFromHex("5fc4722ae367f19055977d1f")
+	price, _ := primitive.ParseDecimal128("19.99")
+	doc := bson.M{
+		"_id":      oid,
+		"name":     "Alice",
+		"age":      int32(30),
+		"height":   5.5,
+		"dead":     false,
+		"person":   bson.M{"name": "Alice", "age": int64(30)},
+		"tagArray": bson.A{"customer:ARAMARK", "_manufacturer:GMC"},
+		"readings": bson.A{bson.M{"type": "temp", "value": 21.5}, bson.M{"type": "humidity", "value": int32(60)}},
+		"lastSeen": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+		"nothing":  nil,
+	}
+
+	s.testMatchVectors([]matchVector{
+		{e: "name == Alice", d: doc, m: true},
+		{e: "name == Bob", d: doc, m: false},
+		{e: "name != Bob", d: doc, m: true},
+		{e: "age > 18 && height < 6", d: doc, m: true},
+		{e: "age >= 30 && age <= 30", d: doc, m: true},
+		{e: "age > 30", d: doc, m: false},
+		{e: "height == 5.5", d: doc, m: true},
+		{e: "age == 30.0", d: doc, m: true},
+		{e: "dead == false", d: doc, m: true},
+		{e: "person.name == Alice && person.age == 30", d: doc, m: true},
+		{e: "name", d: doc, m: true},
+		{e: "!missing", d: doc, m: true},
+		{e: "nothing", d: doc, m: true},
+		{e: "exists(person.age)", d: doc, m: true},
+		{e: "nexists(person.age)", d: doc, m: false},
+		{e: "_id == 5fc4722ae367f19055977d1f", d: doc, m: true},
+		{e: "name == (Bob | Alice)", d: doc, m: true},
+		{e: "name != (Bob | Alice)", d: doc, m: false},
+		{e: "name == (\"B*\" | \"A*\")", d: doc, m: true},
+		{e: "tagArray == \"customer:ARAMARK\"", d: doc, m: true},
+		{e: "tagArray == (\"customer:ARAMARK\" & \"_manufacturer:GMC\")", d: doc, m: true},
+		{e: "tagArray == (\"customer:ARAMARK\" & \"_manufacturer:Buick\")", d: doc, m: false},
+		{e: "tagArray == (\"customer:ARAMARK\" & \"_manufacturer:Buick\") || tagArray == (\"customer:ARAMARK\" & \"_manufacturer:GMC\")", d: doc, m: true},
+		{e: "tagArray all [\"customer:ARAMARK\", \"_manufacturer:GMC\"] && name in [Bob, Alice] && age not in [31, 32]", d: doc, m: true},
+		{e: "tagArray any [x, \"customer:ARAMARK\"] && name not in []", d: doc, m: true},
+		{e: "name in []", d: doc, m: false},
+		{e: "tagArray all []", d: doc, m: false},
+		{e: "readings.type == humidity", d: doc, m: true},
+		{e: "readings.value > 50", d: doc, m: true},
+		{e: "readings.0.type == temp", d: doc, m: true},
+		{e: "readings.1.type == temp", d: doc, m: false},
+		{e: "readings[1].type == humidity && readings[0].value < 22", d: doc, m: true},
+		{e: "elemMatch(readings, type == temp && value > 20)", d: doc, m: true},
+		{e: "elemMatch(readings, type == temp && value > 50)", d: doc, m: false},
+		{e: "elemMatch(readings, type == humidity || value > 100) && !elemMatch(readings, !type)", d: doc, m: true},
+		{e: "elemMatch(tagArray, x == 1) || elemMatch(name, x == 1)", d: doc, m: false},
+		{e: "size(tagArray) == 2 && size(readings) != 3 && size(readings) >= 2", d: doc, m: true},
+		{e: "size(tagArray) > 2 || size(name) == 0", d: doc, m: false},
+		{e: "size(missing) < 1 && size(name) + 2 == size(readings)", d: doc, m: true},
+		{e: "nothing == null && missing == nil && name != null", d: doc, m: true},
+		{e: "name == null || nothing != null", d: doc, m: false},
+		{e: "isString(name) && isNumber(age) && isType(lastSeen, date) && isType(tagArray, array, int)", d: doc, m: true},
+		{e: "isType(tagArray, string) && isType(nothing, \"null\") && isType(person, object) && isType(_id, objectId)", d: doc, m: true},
+		{e: "isNumber(name) || isType(age, long) || isType(missing, \"null\") || isString(tagArray.x)", d: doc, m: false},
+		{e: "name == regex(\"^ali\")", d: doc, m: true},
+		{e: "name == /^ali/", d: doc, m: false},
+		{e: "name == contains(lic)", d: doc, m: true},
+		{e: "lastSeen > date(\"2020-11-01T00:00:00Z\")", d: doc, m: true},
+		{e: "age > 40 || name == Alice", d: doc, m: true},
+		{e: "age > 40 || (name == Bob && age > 10)", d: doc, m: false},
+		{e: "age > 10 && age < 20", d: doc, m: false},
+		{e: "age in 18..65 && lastSeen in date(\"2020-11-01T00:00:00Z\")..date(\"2030-01-01T00:00:00Z\") && between(age, 30, 31)", d: doc, m: true},
+		{e: "age in 18..30 || between(age, 31, 40)", d: doc, m: false},
+		{e: "!(name == Bob)", d: doc, m: true},
+		{e: "name > 5", d: doc, m: false},
+		{e: "price < 20 && price > 19.5", d: bson.M{"price": price}, m: true},
+		{e: "age > $person.age || height > $age", d: doc, m: false},
+		{e: "age == $person.age && name == $person.name", d: doc, m: true},
+		{e: "lastSeen != $missing && nothing == $missing", d: doc, m: true},
+		{e: "age * 2 - 1 == 59", d: doc, m: true},
+		{e: "height * 2 > $age", d: doc, m: false},
+		{e: "(person.age - age) / 2 >= $height", d: doc, m: false},
+		{e: "height * 10 % 7 == 6", d: doc, m: true},
+		{e: "missing + 1 == $nothing", d: doc, m: true},
+		{e: "lastSeen - 86400000 < date(\"2020-11-30T12:00:00Z\") + 0", d: doc, m: true},
+	})
+}
+
+func (s *ReportSuite) TestMatchDocuments() {
+	m, err := NewMatcher("name == Alice && readings.value > 50 && tagArray == (a & b) && lastSeen > date(\"2020-11-01T00:00:00Z\")")
+	s.Require().NoError(err)
+
+	dev := device{
+		ID:       primitive.NewObjectID(),
+		Name:     "Alice",
+		Tags:     []string{"a", "b", "c"},
+		Readings: []sensorReading{{Type: "temp", Value: 21.5}, {Type: "humidity", Value: 60}},
+		LastSeen: time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC),
+	}
+	matched, err := m.Match(dev)
+	s.NoError(err)
+	s.True(matched)
+	matched, err = m.Match(&dev)
+	s.NoError(err)
+	s.True(matched)
+
+	dev.Tags = []string{"a"}
+	matched, err = m.Match(dev)
+	s.NoError(err)
+	s.False(matched)
+
+	matched, err = m.Match(bson.D{{Key: "name", Value: "Alice"}, {Key: "readings", Value: bson.A{bson.D{{Key: "value", Value: 51}}}},
+		{Key: "tagArray", Value: bson.A{"b", "a"}}, {Key: "lastSeen", Value: primitive.NewDateTimeFromTime(dev.LastSeen)}})
+	s.NoError(err)
+	s.True(matched)
+
+	_, err = m.Match(42)
+	s.Error(err)
+
+	m, err = NewMatcher("search(bob)")
+	s.Require().NoError(err)
+	_, err = m.Match(bson.M{})
+	s.EqualError(err, "unsupported operator: $text")
+}
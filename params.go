@@ -0,0 +1,244 @@
+package mongoq
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NamedParam is the value of a named placeholder such as :deviceId.
+type NamedParam struct {
+	Name  string
+	Value any
+}
+
+// Named returns the value of the placeholder :name, for use with ParseQueryWithParams or Template.Bind.
+func Named(name string, value any) NamedParam {
+	return NamedParam{Name: name, Value: value}
+}
+
+// Template is a parsed expression with placeholders that can be bound to values any number of times.  It is safe for
+// concurrent use.
+type Template struct {
+	p    *Parser
+	expr string
+	ast  node
+}
+
+// Prepare parses expr into a Template using the default parser.
+func Prepare(expr string) (*Template, error) {
+	return defaultParser.Prepare(expr)
+}
+
+// Prepare parses expr, which may contain placeholders, into a Template.  Errors that depend on the values, such as a
+// missing parameter, are reported by Bind.
+func (p *Parser) Prepare(expr string) (*Template, error) {
+	exprAst, err := p.parseAST(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{p: p, expr: expr, ast: exprAst}, nil
+}
+
+// ParseQueryWithParams converts expr into a MongoDB filter using the default parser, binding its placeholders to
+// params.
+func ParseQueryWithParams(expr string, params ...any) (bson.M, error) {
+	return defaultParser.ParseWithParams(expr, params...)
+}
+
+// ParseWithParams converts expr into a MongoDB filter, binding its placeholders to params.  Each ? takes the next
+// positional parameter, and :name takes the value given with Named(name, value).  Values are used as they are, without
+// being parsed, so a string is always a string and never a wildcard, regex, field or ObjectID.
+func (p *Parser) ParseWithParams(expr string, params ...any) (bson.M, error) {
+	t, err := p.Prepare(expr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Bind(params...)
+}
+
+// Bind converts the template into a MongoDB filter with its placeholders bound to params, as ParseWithParams does.
+func (t *Template) Bind(params ...any) (bson.M, error) {
+	d, err := t.BindD(params...)
+	if err != nil {
+		return nil, err
+	}
+	return toMap(d).(bson.M), nil
+}
+
+// BindD is like Bind, but returns an ordered filter like ParseD.
+func (t *Template) BindD(params ...any) (bson.D, error) {
+	d, _, err := t.p.convert(t.expr, t.ast, newBindings(params), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return t.p.scoped(d), nil
+}
+
+// bindings are the values of the placeholders of one conversion.
+type bindings struct {
+	positional []any
+	named      map[string]any
+}
+
+func newBindings(params []any) *bindings {
+	b := &bindings{}
+	for _, param := range params {
+		if named, ok := param.(NamedParam); ok {
+			if b.named == nil {
+				b.named = map[string]any{}
+			}
+			b.named[named.Name] = named.Value
+		} else {
+			b.positional = append(b.positional, param)
+		}
+	}
+	return b
+}
+
+func (e *paramExpr) String() string {
+	if e.Name != "" {
+		return ":" + e.Name
+	}
+	return strconv.Itoa(e.Index + 1)
+}
+
+// misplaced reports a placeholder used as a field or a condition rather than as a value.
+func (e *paramExpr) misplaced() error {
+	return nodeError(CodeInvalidOperand, e, "compare a field with it, e.g. name == ?", "parameter %s can only be used as a value", e)
+}
+
+// paramValue returns the value bound to a placeholder.
+func (c *converter) paramValue(e *paramExpr) (any, error) {
+	var v any
+	found := false
+	if c.params != nil {
+		if e.Name != "" {
+			v, found = c.params.named[e.Name]
+		} else if e.Index < len(c.params.positional) {
+			v, found = c.params.positional[e.Index], true
+		}
+	}
+	if e.Name == "" && e.Index >= c.positional {
+		c.positional = e.Index + 1
+	}
+	if !found {
+		return nil, nodeError(CodeInvalidParam, e, "", "missing value for parameter %s", e)
+	}
+	return v, nil
+}
+
+// checkParams reports positional parameters without a placeholder.
+func (c *converter) checkParams(inputLen int) error {
+	if c.params != nil && len(c.params.positional) > c.positional {
+		return newParseError(CodeInvalidParam, 0, inputLen, "", "expected %d parameters, got %d", c.positional, len(c.params.positional))
+	}
+	return nil
+}
+
+// convertParam converts a placeholder into its bound value, or for the list of in, not in, all or any into the same
+// $in or $all document as a written list.
+func (c *converter) convertParam(e *paramExpr, parentOp *tokenKind) (any, error) {
+	if parentOp == nil || binarOpIsLogical(*parentOp) {
+		return nil, e.misplaced()
+	}
+	v, err := c.paramValue(e)
+	if err != nil {
+		return nil, err
+	}
+	list, isList, err := bindList(v)
+	if err == nil && !isList {
+		var value any
+		if value, err = bindValue(v); err == nil {
+			list = []any{value}
+		}
+	}
+	if err != nil {
+		return nil, nodeError(CodeInvalidParam, e, "", "parameter %s: %v", e, err)
+	}
+	switch {
+	case isList && !e.List:
+		return nil, nodeError(CodeInvalidParam, e, "use it with in, not in, all or any", "parameter %s is a list", e)
+	case !isList && e.List:
+		return nil, nodeError(CodeInvalidParam, e, "bind a slice", "parameter %s is not a list", e)
+	}
+	for _, value := range list {
+		if _, isRegex := value.(primitive.Regex); isRegex && !c.p.regex {
+			return nil, nodeError(CodeInvalidParam, e, "use contains() or a wildcard instead", "regular expressions are not allowed")
+		}
+		if err := c.checkRegex(value, e); err != nil {
+			return nil, err
+		}
+	}
+	if !e.List {
+		return list[0], nil
+	}
+	if err := c.checkListSize(list, e); err != nil {
+		return nil, err
+	}
+	operator := "$in"
+	if *parentOp == tokAll {
+		operator = "$all"
+	}
+	return bson.D{{Key: operator, Value: list}}, nil
+}
+
+// bindList converts a slice or array, other than []byte, into a list of values.
+func bindList(v any) ([]any, bool, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false, nil
+	}
+	list := make([]any, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		item := rv.Index(i).Interface()
+		if _, isList, _ := bindList(item); isList {
+			return nil, true, fmt.Errorf("lists cannot be nested")
+		}
+		value, err := bindValue(item)
+		if err != nil {
+			return nil, true, err
+		}
+		list = append(list, value)
+	}
+	return list, true, nil
+}
+
+// bindValue converts a Go value into the BSON value it is compared with; integers become int64 like integer
+// literals do.
+func bindValue(v any) (any, error) {
+	switch tv := v.(type) {
+	case nil, string, bool, int64, float64, time.Time, primitive.DateTime, primitive.ObjectID,
+		primitive.Decimal128, primitive.Binary, primitive.Regex:
+		return tv, nil
+	case []byte:
+		return primitive.Binary{Data: tv}, nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return bindValue(rv.Elem().Interface())
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d does not fit in an int64", rv.Uint())
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
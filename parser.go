@@ -0,0 +1,272 @@
+package mongoq
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Parser converts mongoq expressions into MongoDB filters.  A Parser is configured with NewParser and is then safe for
+// concurrent use, including RegisterFunction; differently configured parsers can be used side by side.
+type Parser struct {
+	onError         func(expr string, err error)
+	functions       *registry
+	wildcards       bool
+	regex           bool
+	caseInsensitive bool
+	limits          Limits
+	schema          *Schema
+	fieldMap        map[string]string
+	fieldResolver   FieldResolver
+	scope           bson.D
+	cache           *queryCache
+	clock           func() time.Time
+}
+
+// Limits bounds the size of the expressions a Parser accepts, so that expressions from untrusted users cannot produce
+// arbitrarily expensive filters.  A zero value means no limit, other than a nesting depth of 10000, so a parser for
+// untrusted input should always set them; MaxLength 4096, MaxDepth 16, MaxClauses 50, MaxListSize 100 and MaxRegexes 5
+// allow any reasonable hand-written filter.  Violations are reported as a ParseError with CodeLimitExceeded, which
+// matches ErrLimitExceeded.
+type Limits struct {
+	MaxLength   int  // maximum length of the expression in bytes
+	MaxDepth    int  // maximum nesting depth of the expression, never more than 10000
+	MaxClauses  int  // maximum number of conditions joined with && and ||
+	MaxListSize int  // maximum number of values in a (a | b) or (a & b) list
+	MaxRegexes  int  // maximum number of regexes, including wildcards and contains()
+	AnchorRegex bool // reject regexes that do not start with ^, which cannot use an index
+}
+
+// Option configures a Parser.
+type Option func(p *Parser)
+
+// WithErrorHandler sets a function that is called with the original expression whenever parsing fails.
+func WithErrorHandler(fn func(expr string, err error)) Option {
+	return func(p *Parser) {
+		p.onError = fn
+	}
+}
+
+// WithWildcards controls whether a '*' in a string value is expanded into a regex.  Enabled by default.
+func WithWildcards(enabled bool) Option {
+	return func(p *Parser) {
+		p.wildcards = enabled
+	}
+}
+
+// WithRegex controls whether raw regular expressions (/.../ literals, "/.../" strings and regex()) are accepted.
+// Enabled by default.
+func WithRegex(enabled bool) Option {
+	return func(p *Parser) {
+		p.regex = enabled
+	}
+}
+
+// WithCaseInsensitive controls whether generated regexes, other than /.../ literals which carry their own options,
+// are case-insensitive.  Enabled by default.
+func WithCaseInsensitive(enabled bool) Option {
+	return func(p *Parser) {
+		p.caseInsensitive = enabled
+	}
+}
+
+// WithLimits sets the limits enforced while parsing.
+func WithLimits(limits Limits) Option {
+	return func(p *Parser) {
+		p.limits = limits
+	}
+}
+
+// WithScope adds constraints, e.g. bson.D{{Key: "tenantId", Value: id}}, that are ANDed with every filter the parser
+// produces.  The expression cannot override or OR around them: they are merged into the top level of the filter as
+// && merges conditions, and the filter becomes an $and of the scope and the expression when keys conflict.  Calling
+// WithScope more than once combines the scopes.
+func WithScope(scope bson.D) Option {
+	return func(p *Parser) {
+		d := toDocument(scope).(bson.D)
+		if p.scope == nil {
+			p.scope = d
+			return
+		}
+		merged, _ := mergeAnd(p.scope, d)
+		p.scope = merged.(bson.D)
+	}
+}
+
+// WithClock sets the function that returns the current time for dateRelative() and the other volatile functions, e.g.
+// a fixed time in tests.  The default is time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(p *Parser) {
+		p.clock = clock
+	}
+}
+
+// WithCache keeps up to size compiled expressions, least recently used first out, so that Compile, Parse and the
+// other methods taking an expression only parse each distinct expression once.  Expressions that differ only in
+// spacing share an entry.  A size of zero or less disables the cache.
+func WithCache(size int) Option {
+	return func(p *Parser) {
+		p.cache = nil
+		if size > 0 {
+			p.cache = newQueryCache(size)
+		}
+	}
+}
+
+// NewParser creates a Parser with the default configuration modified by opts.
+func NewParser(opts ...Option) *Parser {
+	p := &Parser{
+		functions:       newRegistry(defaultFunctions),
+		wildcards:       true,
+		regex:           true,
+		caseInsensitive: true,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+var defaultParser = NewParser()
+
+// With returns a copy of the parser with opts applied, e.g. to scope a shared parser to the tenant of a request.  The
+// copy starts with the parser's functions; functions registered on either afterwards are not shared.  A copy of a
+// parser with a cache gets an empty cache of the same size.
+func (p *Parser) With(opts ...Option) *Parser {
+	cp := *p
+	cp.functions = newRegistry(p.functions)
+	if p.cache != nil {
+		cp.cache = newQueryCache(p.cache.size)
+	}
+	for _, opt := range opts {
+		opt(&cp)
+	}
+	return &cp
+}
+
+// Parse converts expr into a MongoDB filter.
+func (p *Parser) Parse(expr string) (bson.M, error) {
+	d, err := p.ParseD(expr)
+	if err != nil {
+		return nil, err
+	}
+	return toMap(d).(bson.M), nil
+}
+
+// ParseD converts expr into a MongoDB filter whose keys, including those of merged conditions, appear in the order
+// the terms were written.
+func (p *Parser) ParseD(expr string) (bson.D, error) {
+	d, err := p.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	return p.scoped(d), nil
+}
+
+// scoped adds the scope to a filter.
+func (p *Parser) scoped(d bson.D) bson.D {
+	if p.scope != nil {
+		merged, _ := mergeAnd(p.scope, d)
+		d = merged.(bson.D)
+	}
+	return d
+}
+
+// parse converts expr into a filter without the scope, through the cache if the parser has one.
+func (p *Parser) parse(expr string) (bson.D, error) {
+	if p.cache != nil {
+		q, err := p.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return q.filterD(time.Time{})
+	}
+	exprAst, err := p.parseAST(expr)
+	if err != nil {
+		return nil, err
+	}
+	d, _, err := p.convert(expr, exprAst, nil, time.Time{})
+	return d, err
+}
+
+// checkLength enforces the length limit.
+func (p *Parser) checkLength(expr string) error {
+	if p.limits.MaxLength > 0 && len(expr) > p.limits.MaxLength {
+		return p.fail(expr, newParseError(CodeLimitExceeded, p.limits.MaxLength, len(expr), "shorten the expression", "expression longer than %d bytes", p.limits.MaxLength))
+	}
+	return nil
+}
+
+// parseAST checks the length of expr and parses it.
+func (p *Parser) parseAST(expr string) (node, error) {
+	if err := p.checkLength(expr); err != nil {
+		return nil, err
+	}
+
+	// Parse the expression and generate an AST
+	exprAst, err := parseExpr(expr, p.limits)
+	if err != nil {
+		return nil, p.fail(expr, err)
+	}
+	return exprAst, nil
+}
+
+// convert converts the AST of expr into a filter without the scope, binding its placeholders to params and evaluating
+// volatile functions at now, or at the time of the parser's clock if now is zero.  It also reports whether a volatile
+// function was called, in which case the filter is only valid for the time being.
+func (p *Parser) convert(expr string, exprAst node, params *bindings, now time.Time) (bson.D, bool, error) {
+	// Convert the AST to a MongoDB query
+	c := &converter{p: p, params: params, now: now}
+	query, err := c.convertExprToMongoQuery(exprAst, nil)
+	if err == nil {
+		err = c.checkParams(len(expr))
+	}
+	if err != nil {
+		return nil, false, p.fail(expr, err)
+	}
+
+	d, ok := query.(bson.D)
+	if !ok {
+		return nil, false, p.fail(expr, nodeError(CodeInvalidExpression, exprAst, "use a condition such as name == value", "expression is not a filter"))
+	}
+
+	return d, c.volatile, nil
+}
+
+// now returns the current time according to the parser's clock.
+func (p *Parser) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+func (p *Parser) fail(expr string, err error) *ParseError {
+	pe := locateError(expr, err)
+	if p.onError != nil {
+		p.onError(expr, pe)
+	} else {
+		onError(expr, pe)
+	}
+	return pe
+}
+
+func (p *Parser) regexOptions() string {
+	if p.caseInsensitive {
+		return "i"
+	}
+	return ""
+}
+
+// converter holds the state of a single conversion of an AST into a MongoDB filter.
+type converter struct {
+	p          *Parser
+	regexes    int
+	target     *Field // declared field the value being converted is compared against
+	targetName string
+	elem       string // path of the array whose elements an elemMatch() condition applies to
+	params     *bindings
+	positional int       // number of positional parameters used
+	volatile   bool      // a volatile function was called
+	now        time.Time // the time volatile functions are evaluated at, read from the clock when first needed
+}
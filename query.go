@@ -1,11 +1,7 @@
 package mongoq
 
 import (
-	"fmt"
-	"go/ast"
-	"go/parser"
-	"go/token"
-	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,6 +12,9 @@ import (
 	"github.com/qwerty-iot/tox"
 )
 
+// OnErrorCallback is called by parsers without their own error handler whenever parsing fails.
+//
+// Deprecated: use NewParser with WithErrorHandler.
 var OnErrorCallback func(originalExpression string, err error)
 
 func onError(originalExpression string, err error) {
@@ -24,66 +23,14 @@ func onError(originalExpression string, err error) {
 	}
 }
 
-func doubleQuoteKeyword(expr string, keyword string) string {
-	re := regexp.MustCompile(`\b` + keyword + `\b`)
-	matches := re.FindAllStringIndex(expr, -1)
-
-	// If no matches found, return the original string
-	if len(matches) == 0 {
-		return expr
-	}
-
-	// Build a new string with matched "type" words enclosed in double-quotes
-	var b strings.Builder
-	prevEnd := 0
-	for _, match := range matches {
-		start, end := match[0], match[1]
-		b.WriteString(expr[prevEnd:start]) // Write everything before the match
-		if start == 0 || end == len(expr) || (expr[start-1:start] != `"` && expr[end:end+1] != `"`) {
-			b.WriteString(`"` + keyword + `"`) // Enclose the match in double-quotes
-		} else {
-			b.WriteString(expr[start:end]) // Match is already enclosed in double-quotes
-		}
-		prevEnd = end
-	}
-	b.WriteString(expr[prevEnd:]) // Write everything after the last match
-
-	return b.String()
-}
-
+// ParseQuery converts expr into a MongoDB filter using the default parser.
 func ParseQuery(expr string) (bson.M, error) {
-	// Parse the expression and generate an AST
-	expr = strings.TrimSpace(expr)
-
-	expr = strings.Replace(expr, "“", "\"", -1)
-	expr = strings.Replace(expr, "”", "\"", -1)
-	expr = strings.Replace(expr, "\\", "\\\\", -1)
-	expr = strings.Replace(expr, " and ", " && ", -1)
-	expr = strings.Replace(expr, " or ", " || ", -1)
-	expr = strings.Replace(expr, " AND ", " && ", -1)
-	expr = strings.Replace(expr, " OR ", " && ", -1)
-	expr = doubleQuoteKeyword(expr, "type")
-
-	fset := token.NewFileSet()
-	exprAst, err := parser.ParseExprFrom(fset, "", expr, 0)
-	if err != nil {
-		onError(expr, err)
-		return nil, err
-	}
-
-	// Convert the AST to a MongoDB query
-	query, err := convertExprToMongoQuery(exprAst, nil)
-	if err != nil {
-		onError(expr, err)
-		return nil, err
-	}
-
-	m, ok := query.(bson.M)
-	if !ok {
-		return nil, fmt.Errorf("failed to convert to bson.M")
-	}
+	return defaultParser.Parse(expr)
+}
 
-	return bson.M(m), nil
+// ParseQueryD converts expr into an ordered MongoDB filter using the default parser.
+func ParseQueryD(expr string) (bson.D, error) {
+	return defaultParser.ParseD(expr)
 }
 
 func mergeArrays(leftQuery any, rightQuery any) []any {
@@ -103,31 +50,152 @@ func mergeArrays(leftQuery any, rightQuery any) []any {
 	return rslt
 }
 
-func mergeAnd(leftQuery any, rightQuery any) (any, error) {
-	lm, lok := leftQuery.(bson.M)
-	rm, rok := rightQuery.(bson.M)
+// mergeAnd combines two conditions into one document.  A field that appears in both is kept once if both sides apply
+// different operators to it, e.g. age > 10 && age < 20 becomes {age: {$gt: 10, $lt: 20}}; any other repeated key
+// reverts to $and.
+func mergeAnd(leftQuery any, rightQuery any) (any, bool) {
+	ld, lok := leftQuery.(bson.D)
+	rd, rok := rightQuery.(bson.D)
 	if lok && rok {
 		useAnd := false
-		for rk := range rm {
-			if _, found := lm[rk]; found {
+		for _, re := range rd {
+			if lv, found := lookupKey(ld, re.Key); found && !canMergeOperators(re.Key, lv, re.Value) {
 				// revert to $and
 				useAnd = true
 				break
 			}
 		}
 		if useAnd {
-			return bson.M{
-				"$and": []any{leftQuery, rightQuery},
-			}, nil
+			return bson.D{
+				{Key: "$and", Value: []any{leftQuery, rightQuery}},
+			}, true
 		} else {
-			for rk, rv := range rm {
-				lm[rk] = rv
+			merged := make(bson.D, 0, len(ld)+len(rd))
+			merged = append(merged, ld...)
+			for _, re := range rd {
+				if i := indexKey(merged, re.Key); i >= 0 {
+					ops := make(bson.D, 0, len(merged[i].Value.(bson.D))+len(re.Value.(bson.D)))
+					ops = append(ops, merged[i].Value.(bson.D)...)
+					merged[i].Value = append(ops, re.Value.(bson.D)...)
+					continue
+				}
+				merged = append(merged, re)
 			}
-			return lm, nil
+			return merged, true
 		}
 	} else {
-		return nil, fmt.Errorf("unsupported use of: '&&'")
+		return nil, false
+	}
+}
+
+// canMergeOperators reports whether the conditions left and right on the field key can be written as one operator
+// document: both must be operator documents without an operator in common.  $regex and $options belong together and
+// are never merged with each other.
+func canMergeOperators(key string, left any, right any) bool {
+	if strings.HasPrefix(key, "$") {
+		return false
+	}
+	lops, lok := left.(bson.D)
+	rops, rok := right.(bson.D)
+	if !lok || !rok || !isOperatorDoc(lops) || !isOperatorDoc(rops) {
+		return false
+	}
+	for _, re := range rops {
+		if _, found := lookupKey(lops, re.Key); found {
+			return false
+		}
+		if re.Key == "$regex" || re.Key == "$options" {
+			if _, found := lookupKey(lops, "$regex"); found {
+				return false
+			}
+			if _, found := lookupKey(lops, "$options"); found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isOperatorDoc(d bson.D) bool {
+	if len(d) == 0 {
+		return false
+	}
+	for _, e := range d {
+		if !strings.HasPrefix(e.Key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func indexKey(d bson.D, key string) int {
+	for i, e := range d {
+		if e.Key == key {
+			return i
+		}
 	}
+	return -1
+}
+
+func lookupKey(d bson.D, key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// toDocument converts a bson.M, as returned by custom functions, into a bson.D with sorted keys so that output
+// stays deterministic.  Nested documents and arrays are converted too.
+func toDocument(v any) any {
+	switch tv := v.(type) {
+	case bson.M:
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := make(bson.D, 0, len(tv))
+		for _, k := range keys {
+			d = append(d, bson.E{Key: k, Value: toDocument(tv[k])})
+		}
+		return d
+	case map[string]any:
+		return toDocument(bson.M(tv))
+	case bson.D:
+		d := make(bson.D, 0, len(tv))
+		for _, e := range tv {
+			d = append(d, bson.E{Key: e.Key, Value: toDocument(e.Value)})
+		}
+		return d
+	case []any:
+		arr := make([]any, 0, len(tv))
+		for _, e := range tv {
+			arr = append(arr, toDocument(e))
+		}
+		return arr
+	}
+	return v
+}
+
+// toMap converts the bson.D documents built by the converter into bson.M, recursively.
+func toMap(v any) any {
+	switch tv := v.(type) {
+	case bson.D:
+		m := make(bson.M, len(tv))
+		for _, e := range tv {
+			m[e.Key] = toMap(e.Value)
+		}
+		return m
+	case []any:
+		arr := make([]any, 0, len(tv))
+		for _, e := range tv {
+			arr = append(arr, toMap(e))
+		}
+		return arr
+	}
+	return v
 }
 
 func isRegex(value any) (string, bool) {
@@ -147,119 +215,222 @@ func isRegex(value any) (string, bool) {
 	}
 }
 
-func convertBinaryOp(e *ast.BinaryExpr, parentOp *token.Token) (any, error) {
+func (c *converter) convertBinaryOp(e *binaryExpr, parentOp *tokenKind) (any, error) {
 	operator := binaryOpToMongoOperator(e.Op)
 
-	leftQuery, err := convertExprToMongoQuery(e.X, &e.Op)
+	// lists inherit the field being compared against, conditions and comparisons start afresh
+	target, targetName := c.target, c.targetName
+	defer func() { c.target, c.targetName = target, targetName }()
+	if binarOpIsLogical(e.Op) || isComparison(e.Op) {
+		c.target, c.targetName = nil, ""
+	}
+	if isComparison(e.Op) && (isArithmetic(e.X) || isArithmetic(e.Y)) {
+		return c.convertArithmeticComparison(e, operator, parentOp)
+	}
+
+	if param, ok := e.X.(*paramExpr); ok {
+		return nil, param.misplaced()
+	}
+	if id, ok := e.X.(*ident); ok && isComparison(e.Op) && isNullKeyword(id.Name) {
+		// null is a value, which is only compared on the right
+		return nil, nodeError(CodeInvalidOperand, id, "compare a field with null, e.g. name == null", "invalid left operand for operator '%s'", e.Op)
+	}
+	leftQuery, err := c.convertExprToMongoQuery(e.X, &e.Op)
 	if err != nil {
 		return nil, err
 	}
-	rightQuery, err := convertExprToMongoQuery(e.Y, &e.Op)
+	if ref, ok := leftQuery.(*fieldRef); ok {
+		if !isComparison(e.Op) {
+			return nil, ref.misplaced()
+		}
+		leftQuery = ref.name
+	}
+	if size, ok := leftQuery.(*arraySize); ok {
+		if !isComparison(e.Op) {
+			return nil, size.misplaced()
+		}
+		return c.compareSize(operator, size, e)
+	}
+	// only comparisons have a field on the left; for && and || it is the converted condition
+	var key string
+	if isComparison(e.Op) {
+		if key, err = comparisonKey(leftQuery, e); err != nil {
+			return nil, err
+		}
+		if c.p.schema != nil {
+			c.targetName = c.elemPath(key)
+			c.target, _ = c.p.schema.Lookup(c.targetName)
+		}
+	}
+	rightQuery, err := c.convertExprToMongoQuery(e.Y, &e.Op)
 	if err != nil {
 		return nil, err
 	}
 
+	if ref, ok := rightQuery.(*fieldRef); ok {
+		if !isComparison(e.Op) {
+			return nil, ref.misplaced()
+		}
+		return c.compareFields(operator, key, ref, e)
+	}
+	if size, ok := rightQuery.(*arraySize); ok {
+		return nil, size.misplaced()
+	}
+	if rng, ok := e.Y.(*rangeExpr); ok {
+		bounds := rightQuery.(bson.D)
+		return c.rangeCondition(key, bounds[0].Value, bounds[1].Value, e.X, rng.Low, rng.High)
+	}
+
+	var field *Field
+	switch operator {
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		name := key
+		op, value := comparisonOperator(operator, rightQuery)
+		if key, field, err = c.resolveField(name, e.X, op); err != nil {
+			return nil, err
+		}
+		if err = c.checkValue(field, c.elemPath(name), value, e.Y); err != nil {
+			return nil, err
+		}
+	}
+
 	switch operator {
 	case "$eq":
-		return bson.M{
-			tox.ToString(leftQuery): rightQuery,
+		return bson.D{
+			{Key: key, Value: rightQuery},
 		}, nil
 	case "$ne":
-		if rm, rok := rightQuery.(bson.M); rok {
-			if rin, rinf := rm["$in"]; rinf {
-				return bson.M{
-					tox.ToString(leftQuery): bson.M{"$nin": rin},
+		if rd, rok := rightQuery.(bson.D); rok {
+			if rin, rinf := lookupKey(rd, "$in"); rinf {
+				return bson.D{
+					{Key: key, Value: bson.D{{Key: "$nin", Value: rin}}},
 				}, nil
 			}
 		}
-		return bson.M{
-			tox.ToString(leftQuery): bson.M{operator: rightQuery},
+		return bson.D{
+			{Key: key, Value: bson.D{{Key: operator, Value: rightQuery}}},
 		}, nil
 	case "$gt", "$gte", "$lt", "$lte":
-		switch rightQuery.(type) {
-		case int64, float64, time.Time, string:
-		// noop
-		default:
-			return nil, fmt.Errorf("invalid right operand for operator '%s'", e.Op.String())
+		if !isOrderedValue(field, rightQuery) {
+			return nil, nodeError(CodeInvalidOperand, e.Y, "use a number or a date", "invalid right operand for operator '%s'", e.Op.String())
 		}
-		return bson.M{
-			tox.ToString(leftQuery): bson.M{operator: rightQuery},
+		return bson.D{
+			{Key: key, Value: bson.D{{Key: operator, Value: rightQuery}}},
 		}, nil
 	case "$and":
-		return mergeAnd(leftQuery, rightQuery)
+		rslt, ok := mergeAnd(leftQuery, rightQuery)
+		if !ok {
+			return nil, opError(e, "both sides of '&&' must be conditions", "unsupported use of: '%s'", e.Op.String())
+		}
+		return rslt, nil
 	case "$or":
-		if parentOp != nil && *parentOp == token.LOR {
+		if parentOp != nil && *parentOp == tokLOr {
 			// nested or
 			return mergeArrays(leftQuery, rightQuery), nil
 		} else {
-			return bson.M{
-				operator: mergeArrays(leftQuery, rightQuery),
+			return bson.D{
+				{Key: operator, Value: mergeArrays(leftQuery, rightQuery)},
 			}, nil
 		}
 	case "$in":
+		if parentOp != nil && *parentOp == tokAnd {
+			return nil, opError(e, "a list uses either '|' or '&', not both", "unsupported use of: %s", e.Op.String())
+		}
 		rslt := mergeArrays(leftQuery, rightQuery)
-		if parentOp != nil && *parentOp == token.OR {
+		if parentOp != nil && *parentOp == tokOr {
 			// nested or
 			return rslt, nil
-		} else if parentOp != nil && *parentOp == token.EQL {
+		} else if parentOp != nil && *parentOp == tokEql {
 			operator = "$in"
-		} else if parentOp != nil && *parentOp == token.NEQ {
+		} else if parentOp != nil && *parentOp == tokNeq {
 			operator = "$nin"
 		}
-		return bson.M{
-			operator: rslt,
+		if err := c.checkListSize(rslt, e); err != nil {
+			return nil, err
+		}
+		return bson.D{
+			{Key: operator, Value: rslt},
 		}, nil
 	case "$all":
+		if parentOp != nil && *parentOp == tokOr {
+			return nil, opError(e, "a list uses either '|' or '&', not both", "unsupported use of: %s", e.Op.String())
+		}
 		rslt := mergeArrays(leftQuery, rightQuery)
-		if parentOp != nil && *parentOp == token.AND {
-			// nested or
+		if parentOp != nil && *parentOp == tokAnd {
+			// nested and
 			return rslt, nil
-		} else if parentOp != nil && *parentOp == token.EQL {
+		} else if parentOp != nil && *parentOp == tokEql {
 			operator = "$all"
 		}
-		return bson.M{
-			operator: rslt,
+		if err := c.checkListSize(rslt, e); err != nil {
+			return nil, err
+		}
+		return bson.D{
+			{Key: operator, Value: rslt},
 		}, nil
 	default:
-		return nil, fmt.Errorf("unsupported operator: '%s'", e.Op.String())
+		if _, found := arithmeticOperators[e.Op]; found {
+			return nil, opError(e, "compare the result with a value, e.g. a + b > 10", "unsupported use of: %s", e.Op.String())
+		}
+		return nil, opError(e, "", "unsupported operator: '%s'", e.Op.String())
 	}
 }
 
-func convertLiteralOp(e *ast.BasicLit, parentOp *token.Token) (any, error) {
+func opError(e *binaryExpr, hint string, format string, args ...any) *ParseError {
+	return newParseError(CodeUnsupportedOperator, e.OpPos, e.OpEnd, hint, format, args...)
+}
+
+func (c *converter) convertLiteralOp(e *basicLit, parentOp *tokenKind) (any, error) {
+	if e.Kind != tokRegex && parentOp != nil && !binarOpIsLogical(*parentOp) {
+		if v, ok, err := c.coerceLiteral(e.Value, e.Kind, e); ok || err != nil {
+			return v, err
+		}
+	}
 	switch e.Kind {
-	case token.INT:
+	case tokInt:
 		return tox.ToInt64(e.Value), nil
-	case token.FLOAT:
+	case tokFloat:
 		return tox.ToFloat64(e.Value), nil
-	case token.STRING:
-		lcv := strings.ToLower(e.Value)
-		if lcv == "true" {
-			return true, nil
-		} else if lcv == "false" {
-			return false, nil
-		}
-		strValue := strings.Trim(e.Value, `"`)
-		if parentOp == nil || *parentOp == token.LAND {
-			return bson.M{strValue: bson.M{"$exists": true}}, nil
+	case tokRegex:
+		if !c.p.regex {
+			return nil, nodeError(CodeInvalidOperand, e, "use contains() or a wildcard instead", "regular expressions are not allowed")
+		}
+		return primitive.Regex{Pattern: e.Value, Options: e.Options}, nil
+	case tokString:
+		strValue := e.Value
+		if parentOp == nil || *parentOp == tokLAnd {
+			path, _, err := c.resolveField(strValue, e, "$exists")
+			if err != nil {
+				return nil, err
+			}
+			return bson.D{{Key: path, Value: bson.D{{Key: "$exists", Value: true}}}}, nil
 		} else if oid, oidErr := primitive.ObjectIDFromHex(strValue); oidErr == nil {
 			return oid, nil
-		} else if rv, rok := isRegex(strValue); rok {
-			return primitive.Regex{Pattern: rv, Options: "i"}, nil
-		} else if strings.Contains(strValue, "*") {
-			return primitive.Regex{Pattern: strings.ReplaceAll(strValue, "*", ".*"), Options: "i"}, nil
+		} else if rv, rok := isRegex(strValue); rok && c.p.regex {
+			return primitive.Regex{Pattern: rv, Options: c.p.regexOptions()}, nil
+		} else if strings.Contains(strValue, "*") && c.p.wildcards {
+			return primitive.Regex{Pattern: wildcardPattern(strValue), Options: c.p.regexOptions()}, nil
 		} else {
 			return strValue, nil
 		}
 	default:
-		return nil, fmt.Errorf("unsupported literal: %v %v", e.Kind, e)
-		/*case token.:
-			return true, nil
-		case token.FALSE:
-			return false, nil*/
+		return nil, nodeError(CodeInvalidOperand, e, "", "unsupported literal: %v %v", e.Kind, e.Value)
 	}
 }
 
-func convertIdentOp(e *ast.Ident, parentOp *token.Token) (any, error) {
+func (c *converter) convertIdentOp(e *ident, parentOp *tokenKind) (any, error) {
+	if parentOp != nil && isComparison(*parentOp) && isFieldRefName(e.Name) {
+		return &fieldRef{name: e.Name[1:], n: e}, nil
+	}
+	if parentOp != nil && !binarOpIsLogical(*parentOp) {
+		if isNullKeyword(e.Name) {
+			// null matches fields that are null or missing, whatever their declared type
+			return nil, nil
+		}
+		if v, ok, err := c.coerceLiteral(e.Name, tokIdent, e); ok || err != nil {
+			return v, err
+		}
+	}
 	lcv := strings.ToLower(e.Name)
 	if lcv == "true" {
 		return true, nil
@@ -267,7 +438,11 @@ func convertIdentOp(e *ast.Ident, parentOp *token.Token) (any, error) {
 		return false, nil
 	}
 	if parentOp == nil || binarOpIsLogical(*parentOp) {
-		return bson.M{e.Name: bson.M{"$exists": true}}, nil
+		path, _, err := c.resolveField(e.Name, e, "$exists")
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: path, Value: bson.D{{Key: "$exists", Value: true}}}}, nil
 	} else if oid, oidErr := primitive.ObjectIDFromHex(e.Name); oidErr == nil {
 		return oid, nil
 	} else {
@@ -275,121 +450,211 @@ func convertIdentOp(e *ast.Ident, parentOp *token.Token) (any, error) {
 	}
 }
 
-func convertUnaryOp(e *ast.UnaryExpr, parentOp *token.Token) (any, error) {
-	if e.Op == token.NOT {
-		query, err := convertExprToMongoQuery(e.X, &e.Op)
+func (c *converter) convertUnaryOp(e *unaryExpr, parentOp *tokenKind) (any, error) {
+	if e.Op == tokNot {
+		query, err := c.convertExprToMongoQuery(e.X, &e.Op)
 		if err != nil {
 			return nil, err
 		}
+		if ref, ok := query.(*fieldRef); ok {
+			return nil, ref.misplaced()
+		}
+		if size, ok := query.(*arraySize); ok {
+			return nil, size.misplaced()
+		}
 		if qs, ok := query.(string); ok {
-			return bson.M{
-				qs: bson.M{"$exists": false},
+			path, _, err := c.resolveField(qs, e.X, "$exists")
+			if err != nil {
+				return nil, err
+			}
+			return bson.D{
+				{Key: path, Value: bson.D{{Key: "$exists", Value: false}}},
 			}, nil
 		}
-		return bson.M{
-			"$not": query,
+		switch query.(type) {
+		case bson.D, []any:
+		default:
+			// values such as null are not conditions, and MongoDB rejects {$not: null}
+			return nil, nodeError(CodeInvalidOperand, e.X, "negate a field or a condition, e.g. !deleted", "invalid operand for operator '!'")
+		}
+		return bson.D{
+			{Key: "$not", Value: query},
 		}, nil
 	} else {
-		return nil, fmt.Errorf("unsupported unary operator: '%s'", e.Op.String())
+		return nil, newParseError(CodeUnsupportedOperator, e.OpPos, e.OpPos+1, "", "unsupported unary operator: '%s'", e.Op.String())
 	}
 }
 
-func convertCallExpr(e *ast.CallExpr, parentOp *token.Token) (any, error) {
-	funcName := e.Fun.(*ast.Ident).Name
-	switch funcName {
-	case "contains":
-		return callContains(e, parentOp)
-	case "exists":
-		return callExists(e, parentOp)
-	case "nexists":
-		return callNotExists(e, parentOp)
-	case "regex":
-		return callRegex(e, parentOp)
-	case "date":
-		return callDate(e, parentOp)
-	case "dateRelative":
-		return callDateRelative(e, parentOp)
-	case "search":
-		return callSearch(e, parentOp)
-	}
-	return nil, fmt.Errorf("unsupported function: %s", funcName)
-}
-
-func buildNameFromSelector(sel *ast.SelectorExpr) string {
-	switch nt := sel.X.(type) {
-	case *ast.SelectorExpr:
-		return buildNameFromSelector(nt) + "." + sel.Sel.Name
-	case *ast.Ident:
-		return nt.Name + "." + sel.Sel.Name
+// convertListExpr converts the list of in, not in, all or any into the same $in or $all document as the pipe syntax,
+// so that comparisonOperator turns name in [a, b] into name == (a | b).
+func (c *converter) convertListExpr(e *listExpr, parentOp *tokenKind) (any, error) {
+	list := make([]any, 0, len(e.Elems))
+	for _, elem := range e.Elems {
+		v, err := c.convertExprToMongoQuery(elem, parentOp)
+		if err != nil {
+			return nil, err
+		}
+		switch tv := v.(type) {
+		case *fieldRef:
+			return nil, tv.misplaced()
+		case *arraySize:
+			return nil, tv.misplaced()
+		case bson.D, []any:
+			return nil, nodeError(CodeInvalidOperand, elem, "use values such as numbers, strings or dates", "invalid list value")
+		}
+		list = append(list, v)
 	}
-	return ""
+	if err := c.checkListSize(list, e); err != nil {
+		return nil, err
+	}
+	operator := "$in"
+	if *parentOp == tokAll {
+		operator = "$all"
+	}
+	return bson.D{{Key: operator, Value: list}}, nil
 }
 
-func convertExprToMongoQuery(expr ast.Expr, parentOp *token.Token) (any, error) {
+func (c *converter) convertExprToMongoQuery(expr node, parentOp *tokenKind) (any, error) {
 	switch e := expr.(type) {
-	case *ast.BinaryExpr:
+	case *binaryExpr:
 		// Handle binary expressions (e.g. "foo == bar")
-		return convertBinaryOp(e, parentOp)
-	case *ast.UnaryExpr:
+		return c.convertBinaryOp(e, parentOp)
+	case *unaryExpr:
 		// Handle unary expressions (e.g. "!foo")
-		return convertUnaryOp(e, parentOp)
-	case *ast.BasicLit:
-		// Handle literal expressions (e.g. "true", "123")
-		return convertLiteralOp(e, parentOp)
-	case *ast.Ident:
-		// Handle identifier expressions (e.g. "foo"), ie strings without quotes
-		return convertIdentOp(e, parentOp)
-	case *ast.ParenExpr:
-		// Handle parenthesized expressions (e.g. "(foo == bar)")
-		parentOp = new(token.Token)
-		*parentOp = token.LPAREN
-		return convertExprToMongoQuery(e.X, parentOp)
-	case *ast.SelectorExpr:
-		// Handle selector expressions (e.g. "foo.bar")
-		name := buildNameFromSelector(e)
-		if parentOp == nil || binarOpIsLogical(*parentOp) {
-			return bson.M{name: bson.M{"$exists": true}}, nil
-		} else {
-			return name, nil
+		return c.convertUnaryOp(e, parentOp)
+	case *basicLit:
+		// Handle literal expressions (e.g. "true", "123", /foo/)
+		v, err := c.convertLiteralOp(e, parentOp)
+		if err != nil {
+			return nil, err
 		}
-	case *ast.CallExpr:
+		return v, c.checkRegex(v, e)
+	case *ident:
+		// Handle identifier expressions (e.g. "foo", "foo.bar"), ie strings without quotes
+		return c.convertIdentOp(e, parentOp)
+	case *parenExpr:
+		// Handle parenthesized expressions (e.g. "(foo == bar)")
+		parentOp = new(tokenKind)
+		*parentOp = tokLParen
+		return c.convertExprToMongoQuery(e.X, parentOp)
+	case *callExpr:
 		// Handle call expressions (e.g. "foo(bar)")
-		return convertCallExpr(e, parentOp)
+		v, err := c.convertCallExpr(e, parentOp)
+		if err != nil {
+			return nil, err
+		}
+		return v, c.checkRegex(v, e)
+	case *listExpr:
+		// Handle lists (e.g. "[a, b]")
+		return c.convertListExpr(e, parentOp)
+	case *rangeExpr:
+		// Handle ranges (e.g. "18..65")
+		return c.convertRange(e, parentOp)
+	case *paramExpr:
+		// Handle placeholders (e.g. "?", ":deviceId")
+		return c.convertParam(e, parentOp)
 	default:
-		return nil, fmt.Errorf("unsupported ast: %V (%T)", e, e)
+		return nil, nodeError(CodeInvalidExpression, e, "", "unsupported ast: %v (%T)", e, e)
+	}
+}
+
+// isOrderedValue reports whether v can be compared with <, <=, > and >=: numbers and dates, and strings on fields
+// declared as strings.
+func isOrderedValue(f *Field, v any) bool {
+	switch v.(type) {
+	case int64, int32, float64, primitive.Decimal128, time.Time:
+		return true
+	case string:
+		return f != nil && f.Type == TypeString
+	}
+	return false
+}
+
+func isNullKeyword(name string) bool {
+	switch strings.ToLower(name) {
+	case "null", "nil":
+		return true
+	}
+	return false
+}
+
+func isComparison(op tokenKind) bool {
+	switch op {
+	case tokEql, tokNeq, tokLss, tokGtr, tokLeq, tokGeq, tokIn, tokNotIn, tokAll, tokAny:
+		return true
 	}
+	return false
 }
 
-func binarOpIsLogical(op token.Token) bool {
+func binarOpIsLogical(op tokenKind) bool {
 	switch op {
-	case token.LAND, token.LOR:
+	case tokLAnd, tokLOr:
 		return true
 	}
 	return false
 }
 
-func binaryOpToMongoOperator(op token.Token) string {
+// comparisonKey returns the field name on the left of a comparison.
+func comparisonKey(leftQuery any, e *binaryExpr) (string, error) {
+	switch lq := leftQuery.(type) {
+	case string:
+		return lq, nil
+	case bson.D, []any, primitive.Regex, nil:
+		return "", nodeError(CodeInvalidOperand, e.X, "compare a field, e.g. name == Alice", "invalid left operand for operator '%s'", e.Op)
+	}
+	return tox.ToString(leftQuery), nil
+}
+
+func binaryOpToMongoOperator(op tokenKind) string {
 	switch op {
-	case token.EQL:
+	case tokEql, tokIn, tokAny, tokAll:
 		return "$eq"
-	case token.NEQ:
+	case tokNeq, tokNotIn:
 		return "$ne"
-	case token.LSS:
+	case tokLss:
 		return "$lt"
-	case token.GTR:
+	case tokGtr:
 		return "$gt"
-	case token.LEQ:
+	case tokLeq:
 		return "$lte"
-	case token.GEQ:
+	case tokGeq:
 		return "$gte"
-	case token.LAND:
+	case tokLAnd:
 		return "$and"
-	case token.LOR:
+	case tokLOr:
 		return "$or"
-	case token.OR:
+	case tokOr:
 		return "$in"
-	case token.AND:
+	case tokAnd:
 		return "$all"
 	}
 	return ""
 }
+
+// checkRegex validates a converted regex and enforces the regex limits.
+func (c *converter) checkRegex(v any, n node) error {
+	re, ok := v.(primitive.Regex)
+	if !ok {
+		return nil
+	}
+	if err := validateRegex(re.Pattern, re.Options); err != nil {
+		return nodeError(CodeInvalidOperand, n, "use contains(), startsWith() or endsWith() to match text literally", "%v", err)
+	}
+	limits := c.p.limits
+	c.regexes++
+	if limits.MaxRegexes > 0 && c.regexes > limits.MaxRegexes {
+		return nodeError(CodeLimitExceeded, n, "use fewer wildcards or patterns", "expression has more than %d regexes", limits.MaxRegexes)
+	}
+	if limits.AnchorRegex && !strings.HasPrefix(re.Pattern, "^") {
+		return nodeError(CodeLimitExceeded, n, "start the pattern with ^", "regex %s is not anchored", re.Pattern)
+	}
+	return nil
+}
+
+// checkListSize enforces the list size limit on a complete list.
+func (c *converter) checkListSize(list []any, n node) error {
+	if max := c.p.limits.MaxListSize; max > 0 && len(list) > max {
+		return nodeError(CodeLimitExceeded, n, "use fewer values", "list has more than %d values", max)
+	}
+	return nil
+}
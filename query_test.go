@@ -1,6 +1,9 @@
 package mongoq
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,6 +45,7 @@ func (s *ReportSuite) testVectors(vectors []queryVector) {
 		} else {
 			s.NoError(err)
 			s.Equal(vector.r, rslt)
+			s.testRoundTrip(vector.e, rslt)
 		}
 	}
 }
@@ -49,7 +53,7 @@ func (s *ReportSuite) testVectors(vectors []queryVector) {
 func (s *ReportSuite) TestOne() {
 
 	vectors := []queryVector{
-		{n: "in-bad-inner", e: "name == (\"Alice\" | \"Bob\" & \"Charlie\")", r: nil, x: "unsupported use of: &"}}
+		{n: "in-bad-inner", e: "name == (\"Alice\" | \"Bob\" & \"Charlie\")", r: nil, x: "1:26: unsupported use of: &"}}
 	s.testVectors(vectors)
 }
 
@@ -71,7 +75,7 @@ func (s *ReportSuite) TestGoodQueries() {
 		{n: "not-exists", e: "!name", r: primitive.M{"name": primitive.M{"$exists": false}}},
 		{n: "noquotes1", e: "name == Alice", r: primitive.M{"name": "Alice"}},
 		{e: "age > 10 && (name || !desc)", r: primitive.M{"$or": []any{primitive.M{"name": primitive.M{"$exists": true}}, primitive.M{"desc": primitive.M{"$exists": false}}}, "age": primitive.M{"$gt": int64(10)}}},
-		{e: "age > 10 && age < 20", r: primitive.M{"$and": []any{primitive.M{"age": primitive.M{"$gt": int64(10)}}, primitive.M{"age": primitive.M{"$lt": int64(20)}}}}},
+		{e: "age > 10 && age < 20", r: primitive.M{"age": primitive.M{"$gt": int64(10), "$lt": int64(20)}}},
 		{e: "_id == \"5fc4722ae367f19055977d1f\"", r: primitive.M{"_id": primitive.ObjectID{0x5f, 0xc4, 0x72, 0x2a, 0xe3, 0x67, 0xf1, 0x90, 0x55, 0x97, 0x7d, 0x1f}}},
 		{n: "type", e: "\"type\" == \"Alice\"", r: primitive.M{"type": "Alice"}},
 		{n: "double-nested", e: "level1.level2.level3 == \"Alice\"", r: primitive.M{"level1.level2.level3": "Alice"}},
@@ -79,11 +83,58 @@ func (s *ReportSuite) TestGoodQueries() {
 		{n: "one-val", e: "id==(\"64d7b3661b467d611d5f1401\")", r: primitive.M{"id": primitive.ObjectID{0x64, 0xd7, 0xb3, 0x66, 0x1b, 0x46, 0x7d, 0x61, 0x1d, 0x5f, 0x14, 0x01}}},
 		{n: "date-rfc3339", e: "ts==date(\"2020-12-01T00:00:00Z\")", r: primitive.M{"ts": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}},
 		{n: "date-custom", e: "ts==date(\"20201201\",\"20060102\")", r: primitive.M{"ts": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}},
+		{n: "oid-unquoted", e: "_id == 5fc4722ae367f19055977d1f", r: primitive.M{"_id": primitive.ObjectID{0x5f, 0xc4, 0x72, 0x2a, 0xe3, 0x67, 0xf1, 0x90, 0x55, 0x97, 0x7d, 0x1f}}},
 		{n: "fts", e: "\"data.accelerometer_3313.0.x_value_5702\">5", r: primitive.M{"data.accelerometer_3313.0.x_value_5702": primitive.M{"$gt": int64(5)}}},
 	}
 	s.testVectors(vectors)
 }
 
+func (s *ReportSuite) TestKeywordQueries() {
+
+	vectors := []queryVector{
+		{n: "type", e: "type == sensor", r: primitive.M{"type": "sensor"}},
+		{n: "go-keywords", e: "func == a && range > 5 && map.select == b", r: primitive.M{"func": "a", "range": primitive.M{"$gt": int64(5)}, "map.select": "b"}},
+		{n: "and-or-words", e: "a == 1 and b == 2 or c == 3", r: primitive.M{"$or": []any{primitive.M{"a": int64(1), "b": int64(2)}, primitive.M{"c": int64(3)}}}},
+		{n: "upper-or", e: "a == 1 OR b == 2", r: primitive.M{"$or": []any{primitive.M{"a": int64(1)}, primitive.M{"b": int64(2)}}}},
+		{n: "smart-quotes", e: "name == “Alice”", r: primitive.M{"name": "Alice"}},
+		{n: "escaped-smart-quote", e: "name == \"say \\”hi\\”\"", r: primitive.M{"name": "say ”hi”"}},
+		{n: "path-digits", e: "data.temperature_3303.0.value > 5", r: primitive.M{"data.temperature_3303.0.value": primitive.M{"$gt": int64(5)}}},
+	}
+	s.testVectors(vectors)
+}
+
+func (s *ReportSuite) TestOrderedQueries() {
+
+	vectors := []struct {
+		e string
+		r bson.D
+	}{
+		{e: "z == 1 && a == 2 && m > 3", r: bson.D{{Key: "z", Value: int64(1)}, {Key: "a", Value: int64(2)}, {Key: "m", Value: bson.D{{Key: "$gt", Value: int64(3)}}}}},
+		{e: "z == 1 && (y == 2 || x == 3) && a", r: bson.D{{Key: "z", Value: int64(1)}, {Key: "$or", Value: []any{bson.D{{Key: "y", Value: int64(2)}}, bson.D{{Key: "x", Value: int64(3)}}}}, {Key: "a", Value: bson.D{{Key: "$exists", Value: true}}}}},
+		{e: "b > 1 && a == 1 && b < 5", r: bson.D{{Key: "b", Value: bson.D{{Key: "$gt", Value: int64(1)}, {Key: "$lt", Value: int64(5)}}}, {Key: "a", Value: int64(1)}}},
+		{e: "b == 1 && b > 0", r: bson.D{{Key: "$and", Value: []any{bson.D{{Key: "b", Value: int64(1)}}, bson.D{{Key: "b", Value: bson.D{{Key: "$gt", Value: int64(0)}}}}}}}},
+		{e: "b > 1 && b > 2", r: bson.D{{Key: "$and", Value: []any{bson.D{{Key: "b", Value: bson.D{{Key: "$gt", Value: int64(1)}}}}, bson.D{{Key: "b", Value: bson.D{{Key: "$gt", Value: int64(2)}}}}}}}},
+		{e: "name != (b | a) && search(x)", r: bson.D{{Key: "name", Value: bson.D{{Key: "$nin", Value: []any{"b", "a"}}}}, {Key: "$text", Value: bson.D{{Key: "$search", Value: "x"}}}}},
+	}
+	for _, v := range vectors {
+		rslt, err := ParseQueryD(v.e)
+		s.NoError(err, v.e)
+		s.Equal(v.r, rslt, v.e)
+
+		m, err := ParseQuery(v.e)
+		s.NoError(err, v.e)
+		s.Equal(m, toMap(rslt), v.e)
+	}
+
+	// documents returned by custom functions are ordered by key
+	p := NewParser(WithFunctions(Function{Name: "online", Call: func(call *Call) (any, error) {
+		return bson.M{"status": bson.M{"online": true, "checked": true}, "active": true}, nil
+	}}))
+	rslt, err := p.ParseD("online() && a == 1")
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "active", Value: true}, {Key: "status", Value: bson.D{{Key: "checked", Value: true}, {Key: "online", Value: true}}}, {Key: "a", Value: int64(1)}}, rslt)
+}
+
 func (s *ReportSuite) TestNestedQueries() {
 
 	vectors := []queryVector{
@@ -104,8 +155,8 @@ func (s *ReportSuite) TestInNin() {
 		{n: "nin2", e: "name != (\"Alice\" | \"Bob\")", r: primitive.M{"name": primitive.M{"$nin": []any{"Alice", "Bob"}}}},
 		{n: "nin3", e: "name != (\"Alice\" | \"Bob\" | \"Charlie\")", r: primitive.M{"name": primitive.M{"$nin": []any{"Alice", "Bob", "Charlie"}}}},
 		{n: "nin4", e: "name != (\"Alice\" | \"Bob\" | \"Charlie\" | \"Maya\")", r: primitive.M{"name": primitive.M{"$nin": []any{"Alice", "Bob", "Charlie", "Maya"}}}},
-		{n: "in-bad-op", e: "name > (\"Alice\" | \"Bob\" | \"Charlie\")", r: nil, x: "invalid right operand for operator '>'"},
-		{n: "in-bad-inner", e: "name == (\"Alice\" | \"Bob\" & \"Charlie\")", r: nil, x: "unsupported use of: &"},
+		{n: "in-bad-op", e: "name > (\"Alice\" | \"Bob\" | \"Charlie\")", r: nil, x: "1:8: invalid right operand for operator '>'"},
+		{n: "in-bad-inner", e: "name == (\"Alice\" | \"Bob\" & \"Charlie\")", r: nil, x: "1:26: unsupported use of: &"},
 	}
 	s.testVectors(vectors)
 }
@@ -122,21 +173,968 @@ func (s *ReportSuite) TestAll() {
 func (s *ReportSuite) TestBadQueries() {
 
 	vectors := []queryVector{
-		{n: "err-gr-string", e: "person.age >= \"test\"", r: nil, x: "invalid right operand for operator '>='"},
-		{e: "_id == 5fc4722ae367f19055977d1f", x: "1:9: expected 'EOF', found fc4722ae367f19055977d1f"},
+		{n: "err-gr-string", e: "person.age >= \"test\"", r: nil, x: "1:15: invalid right operand for operator '>='"},
+		{n: "unterminated", e: "name == \"Alice", x: "1:9: string literal not terminated"},
+		{n: "dangling-op", e: "name ==", x: "1:8: expected operand, found EOF"},
+		{n: "unbalanced", e: "(name == Alice", x: "1:15: expected ')', found EOF"},
+	}
+	s.testVectors(vectors)
+}
+
+func (s *ReportSuite) TestParseErrors() {
+	_, err := ParseQuery("age > 10 &&\n  name > \"Bob\"")
+	var pe *ParseError
+	s.Require().True(errors.As(err, &pe))
+	s.Equal(CodeInvalidOperand, pe.Code)
+	s.Equal(21, pe.Offset)
+	s.Equal(2, pe.Line)
+	s.Equal(10, pe.Column)
+	s.Equal("\"Bob\"", pe.Token)
+	s.Equal("age > 10 &&\n  name > \"Bob\"", pe.Input)
+	s.NotEmpty(pe.Hint)
+
+	// columns count characters, not bytes
+	_, err = ParseQuery("name == “Alicé” && age > x")
+	s.Require().True(errors.As(err, &pe))
+	s.Equal(30, pe.Offset)
+	s.Equal(26, pe.Column)
+	s.Equal("x", pe.Token)
+
+	_, err = ParseQuery("name == foo(1)")
+	s.Require().True(errors.As(err, &pe))
+	s.Equal(CodeUnsupportedFunction, pe.Code)
+	s.Equal("foo", pe.Token)
+	s.Equal(8, pe.Offset)
+
+	_, err = ParseQuery("ts == date(\"yesterday\")")
+	s.Require().True(errors.As(err, &pe))
+	s.Equal(CodeInvalidArgument, pe.Code)
+	s.Equal("\"yesterday\"", pe.Token)
+
+	_, err = ParseQuery("name == Alice age")
+	s.Require().True(errors.As(err, &pe))
+	s.Equal(CodeSyntax, pe.Code)
+	s.Equal("age", pe.Token)
+	s.Equal("1:15: expected 'EOF', found age", pe.Error())
+
+	_, err = ParseQuery("name ==")
+	s.Require().True(errors.As(err, &pe))
+	s.Equal("EOF", pe.Token)
+}
+
+func (s *ReportSuite) TestParserOptions() {
+	var handled []string
+	strict := NewParser(
+		WithWildcards(false),
+		WithRegex(false),
+		WithCaseInsensitive(false),
+		WithLimits(Limits{MaxLength: 50, MaxDepth: 3}),
+		WithErrorHandler(func(expr string, err error) { handled = append(handled, expr) }),
+	)
+
+	rslt, err := strict.Parse("name == \"Alice*\" && desc == contains(bob)")
+	s.NoError(err)
+	s.Equal(primitive.M{"name": "Alice*", "desc": primitive.Regex{Pattern: ".*bob.*"}}, rslt)
+
+	_, err = strict.Parse("name == /Alice/")
+	s.EqualError(err, "1:9: regular expressions are not allowed")
+	_, err = strict.Parse("name == regex(Alice)")
+	s.EqualError(err, "1:9: regular expressions are not allowed")
+	_, err = strict.Parse("name == \"a very long name that exceeds the length limit\"")
+	s.EqualError(err, "1:51: expression longer than 50 bytes")
+	_, err = strict.Parse("!(!(!(!name)))")
+	s.EqualError(err, "1:4: expression nested deeper than 3 levels")
+	s.Len(handled, 4)
+
+	// the default parser is unaffected
+	rslt, err = ParseQuery("name == \"Alice*\"")
+	s.NoError(err)
+	s.Equal(primitive.M{"name": primitive.Regex{Pattern: "Alice.*", Options: "i"}}, rslt)
+}
+
+func (s *ReportSuite) TestLimits() {
+	p := NewParser(WithLimits(Limits{MaxClauses: 3, MaxListSize: 3, MaxRegexes: 2, AnchorRegex: true}))
+
+	vectors := []struct {
+		e string
+		x string
+	}{
+		{e: "a == 1 && b == 2 || c == 3"},
+		{e: "a == 1 && b == 2 || c == 3 && d == 4", x: "1:28: expression has more than 3 clauses"},
+		{e: strings.Repeat("a == 1 || ", 4000) + "a == 1", x: "1:28: expression has more than 3 clauses"},
+		{e: "a == (1 | 2 | 3) && b != (x | y | z) && c == (p & q & r)"},
+		{e: "a == (1 | 2 | 3 | 4)", x: "1:7: list has more than 3 values"},
+		{e: "c == (p & q & r & s)", x: "1:7: list has more than 3 values"},
+		{e: "name == /^a/ && desc == regex(\"^b\")"},
+		{e: "name == (/^a/ | /^b/ | /^c/)", x: "1:24: expression has more than 2 regexes"},
+		{e: "name == /a/", x: "1:9: regex a is not anchored"},
+		{e: "name == \"Al*\"", x: "1:9: regex Al.* is not anchored"},
+		{e: "name == contains(al)", x: "1:9: regex .*al.* is not anchored"},
+	}
+	for _, v := range vectors {
+		_, err := p.Parse(v.e)
+		if v.x == "" {
+			s.NoError(err, v.e)
+			continue
+		}
+		s.EqualError(err, v.x, v.e)
+		s.ErrorIs(err, ErrLimitExceeded, v.e)
+	}
+
+	_, err := NewParser(WithLimits(Limits{MaxDepth: 1})).Parse("!(a)")
+	s.ErrorIs(err, ErrLimitExceeded)
+
+	// deep nesting is rejected even without limits, rather than overflowing the stack
+	var pe *ParseError
+	for _, e := range []string{
+		strings.Repeat("!", 5_000_000) + "a",
+		strings.Repeat("(", 100_000) + "a == 1" + strings.Repeat(")", 100_000),
+		strings.Repeat("f(", 100_000) + "a" + strings.Repeat(")", 100_000),
+	} {
+		_, err = ParseQuery(e)
+		s.ErrorAs(err, &pe)
+		s.ErrorIs(err, ErrLimitExceeded)
+		s.Contains(err.Error(), "expression nested deeper than 10000 levels")
+	}
+	_, err = ParseQuery(strings.Repeat("!", 9_999) + "a")
+	s.NoError(err)
+
+	// names that MongoDB would read as operators are never fields
+	for _, e := range []string{"\"$where\" == \"sleep(1000)\"", "exists(\"$gt\")", "$a", "a || !$b", "a.$ne == 1", "\"$x\" + 1 > 2", "a == field(\"$b\")", "elemMatch(r, \"$t\" == 1)"} {
+		_, err = ParseQuery(e)
+		if s.ErrorAs(err, &pe, e) {
+			s.Equal(CodeInvalidOperand, pe.Code, e)
+		}
+	}
+	_, err = ParseQuery("\"$where\" == \"sleep(1000)\"")
+	s.EqualError(err, "1:1: invalid field name: $where")
+
+	// long chains convert in linear time, so that they cannot be used to tie up the server
+	for _, op := range []string{" || ", " && "} {
+		start := time.Now()
+		_, err = ParseQuery(strings.Repeat("a == 1"+op, 8000) + "a == 1")
+		s.NoError(err)
+		s.Less(time.Since(start), 2*time.Second, op)
+	}
+	_, err = p.Parse("a == ")
+	s.Error(err)
+	s.NotErrorIs(err, ErrLimitExceeded)
+}
+
+func (s *ReportSuite) TestScope() {
+	base := NewParser(WithScope(bson.D{{Key: "deleted", Value: bson.M{"$ne": true}}}))
+	p := base.With(WithScope(bson.D{{Key: "tenantId", Value: "acme"}}))
+
+	vectors := []struct {
+		e string
+		r bson.D
+	}{
+		{e: "name == Alice", r: bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}, {Key: "tenantId", Value: "acme"}, {Key: "name", Value: "Alice"}}},
+		{e: "name == Alice || tenantId == other", r: bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}, {Key: "tenantId", Value: "acme"},
+			{Key: "$or", Value: []any{bson.D{{Key: "name", Value: "Alice"}}, bson.D{{Key: "tenantId", Value: "other"}}}}}},
+		{e: "tenantId == other && deleted == true", r: bson.D{{Key: "$and", Value: []any{
+			bson.D{{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}}, {Key: "tenantId", Value: "acme"}},
+			bson.D{{Key: "tenantId", Value: "other"}, {Key: "deleted", Value: true}},
+		}}}},
+	}
+	for _, v := range vectors {
+		rslt, err := p.ParseD(v.e)
+		s.NoError(err, v.e)
+		s.Equal(v.r, rslt, v.e)
+	}
+
+	// the base parser keeps its own scope
+	rslt, err := base.Parse("name == Alice")
+	s.NoError(err)
+	s.Equal(primitive.M{"deleted": primitive.M{"$ne": true}, "name": "Alice"}, rslt)
+
+	m, err := p.Matcher("name == Alice")
+	s.Require().NoError(err)
+	matched, err := m.Match(bson.M{"name": "Alice", "tenantId": "other"})
+	s.NoError(err)
+	s.False(matched)
+	matched, err = m.Match(bson.M{"name": "Alice", "tenantId": "acme"})
+	s.NoError(err)
+	s.True(matched)
+}
+
+func (s *ReportSuite) TestCustomFunctions() {
+	var parentOps []string
+	p := NewParser(WithFunctions(
+		Function{Name: "deviceOnline", Call: func(call *Call) (any, error) {
+			parentOps = append(parentOps, call.ParentOp)
+			return bson.M{"status.online": true}, nil
+		}},
+		Function{Name: "tag", Args: []ArgSpec{{Name: "key", Type: ArgString}, {Name: "value", Type: ArgString}}, Call: func(call *Call) (any, error) {
+			return bson.M{"tagArray": call.String(0) + ":" + call.String(1)}, nil
+		}},
+	))
+	s.NoError(p.RegisterFunction(Function{Name: "inGroup", Args: []ArgSpec{{Name: "group", Type: ArgString}, {Name: "depth", Type: ArgInt, Optional: true}}, Call: func(call *Call) (any, error) {
+		if len(call.Args) > 1 && call.Args[1].(int64) > 3 {
+			return nil, call.ArgError(1, "", "depth too large")
+		}
+		return bson.M{"groups": call.String(0)}, nil
+	}}))
+	s.Error(p.RegisterFunction(Function{Name: "broken"}))
+
+	vectors := []struct {
+		e string
+		x string
+		r bson.M
+	}{
+		{e: "deviceOnline()", r: bson.M{"status.online": true}},
+		{e: "tag(\"customer\", ARAMARK) && deviceOnline()", r: bson.M{"tagArray": "customer:ARAMARK", "status.online": true}},
+		{e: "inGroup(g1, 2)", r: bson.M{"groups": "g1"}},
+		{e: "inGroup(g1, 5)", x: "1:13: depth too large"},
+		{e: "inGroup(g1, \"x\")", x: "1:13: inGroup() depth must be of type integer"},
+		{e: "tag(customer)", x: "1:1: tag() expected 2 arguments, got 1"},
+		{e: "tag(a, b, c)", x: "1:11: tag() expected at most 2 arguments, got 3"},
+		{e: "tag(a, (b))", x: "1:8: tag() unsupported argument type"},
+	}
+	for _, v := range vectors {
+		rslt, err := p.Parse(v.e)
+		if v.x != "" {
+			s.EqualError(err, v.x, v.e)
+		} else {
+			s.NoError(err, v.e)
+			s.Equal(v.r, rslt, v.e)
+		}
+	}
+	s.Equal([]string{"", "&&"}, parentOps)
+
+	// functions registered on one parser are not visible to others
+	_, err := ParseQuery("deviceOnline()")
+	s.EqualError(err, "1:1: unsupported function: deviceOnline")
+
+	s.NoError(RegisterFunction(Function{Name: "testGlobal", Call: func(call *Call) (any, error) {
+		return bson.M{"global": true}, nil
+	}}))
+	rslt, err := ParseQuery("testGlobal()")
+	s.NoError(err)
+	s.Equal(bson.M{"global": true}, rslt)
+	rslt, err = NewParser().Parse("testGlobal()")
+	s.NoError(err)
+	s.Equal(bson.M{"global": true}, rslt)
+}
+
+func (s *ReportSuite) TestSchemaValidation() {
+	p := NewParser(WithSchema(NewSchema(
+		Field{Path: "_id", Type: TypeObjectID, Operators: []string{"$eq", "$in"}},
+		Field{Path: "name", Type: TypeString},
+		Field{Path: "age", Type: TypeInt64, Operators: []string{"$eq", "$gt", "$gte", "$lt", "$lte", "$exists"}},
+		Field{Path: "tagArray", Type: TypeString, Array: true},
+		Field{Path: "lastSeen", Type: TypeDate},
+		Field{Path: "data.*", Type: TypeNumber},
+		Field{Path: "meta", Type: TypeObject},
+		Field{Path: "readings.*.value", Type: TypeDouble},
+	)))
+
+	vectors := []struct {
+		e string
+		x string
+		c ErrorCode
+	}{
+		{e: "name == Alice && age > 18 && exists(meta)"},
+		{e: "name > \"M\" && name == contains(ali) && name == (a | b)"},
+		{e: "tagArray == (a & b) && lastSeen > date(\"2020-12-01T00:00:00Z\")"},
+		{e: "data.temperature > 5.5 && data.humidity.value == 3 && readings.0.value < 2"},
+		{e: "_id == (5fc4722ae367f19055977d1f | 64d7b3661b467d611d5f1401)"},
+		{e: "!age && name"},
+		{e: "password == x", x: "1:1: unknown field: password", c: CodeUnknownField},
+		{e: "exists(password)", x: "1:8: unknown field: password", c: CodeUnknownField},
+		{e: "name && password", x: "1:9: unknown field: password", c: CodeUnknownField},
+		{e: "!password", x: "1:2: unknown field: password", c: CodeUnknownField},
+		{e: "data == 5", x: "1:1: unknown field: data", c: CodeUnknownField},
+		{e: "readings.0.type == temp", x: "1:1: unknown field: readings.0.type", c: CodeUnknownField},
+		{e: "age != 5", x: "1:1: operator $ne is not allowed on field age", c: CodeOperatorNotAllowed},
+		{e: "age == (1 | 2)", x: "1:1: operator $in is not allowed on field age", c: CodeOperatorNotAllowed},
+		{e: "_id == 5fc4722ae367f19055977d1f && exists(_id)", x: "1:43: operator $exists is not allowed on field _id", c: CodeOperatorNotAllowed},
+		{e: "age == ten", x: "1:8: field age expects a long value", c: CodeTypeMismatch},
+		{e: "age == regex(\"1.*\")", x: "1:1: operator $regex is not allowed on field age", c: CodeOperatorNotAllowed},
+		{e: "lastSeen == regex(\"1.*\")", x: "1:13: field lastSeen expects a date value", c: CodeTypeMismatch},
+		{e: "name == date(\"2020-12-01T00:00:00Z\")", x: "1:9: field name expects a string value", c: CodeTypeMismatch},
+		{e: "tagArray == (a & date(\"2020-12-01T00:00:00Z\"))", x: "1:13: field tagArray expects a string value", c: CodeTypeMismatch},
+		{e: "lastSeen > 5", x: "1:12: field lastSeen expects a date value", c: CodeTypeMismatch},
+		{e: "meta == 5", x: "1:1: field meta is a subdocument and can only be tested for existence", c: CodeTypeMismatch},
+	}
+	for _, v := range vectors {
+		_, err := p.Parse(v.e)
+		if v.x == "" {
+			s.NoError(err, v.e)
+			continue
+		}
+		s.EqualError(err, v.x, v.e)
+		var pe *ParseError
+		if s.True(errors.As(err, &pe), v.e) {
+			s.Equal(v.c, pe.Code, v.e)
+		}
+	}
+}
+
+func (s *ReportSuite) TestSchemaCoercion() {
+	p := NewParser(WithSchema(NewSchema(
+		Field{Path: "_id", Type: TypeObjectID},
+		Field{Path: "serial", Type: TypeString},
+		Field{Path: "tagArray", Type: TypeString, Array: true},
+		Field{Path: "count", Type: TypeInt32},
+		Field{Path: "total", Type: TypeInt64},
+		Field{Path: "ratio", Type: TypeDouble},
+		Field{Path: "price", Type: TypeDecimal},
+		Field{Path: "dead", Type: TypeBool},
+		Field{Path: "lastSeen", Type: TypeDate},
+		Field{Path: "uuid", Type: TypeUUID},
+		Field{Path: "blob", Type: TypeBinary},
+		Field{Path: "other"},
+	)))
+
+	oid, _ := primitive.ObjectIDFromHex("5fc4722ae367f19055977d1f")
+	price, _ := primitive.ParseDecimal128("19.99")
+	uuid := []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+
+	vectors := []queryVector{
+		{n: "hex-serial", e: "serial == 5fc4722ae367f19055977d1f", r: primitive.M{"serial": "5fc4722ae367f19055977d1f"}},
+		{n: "string-true", e: "serial == \"true\" || serial == false", r: primitive.M{"$or": []any{primitive.M{"serial": "true"}, primitive.M{"serial": "false"}}}},
+		{n: "string-int", e: "serial == 00123", r: primitive.M{"serial": "00123"}},
+		{n: "string-list", e: "tagArray == (a & 5)", r: primitive.M{"tagArray": primitive.M{"$all": []any{"a", "5"}}}},
+		{n: "string-wildcard", e: "serial == \"AB*\"", r: primitive.M{"serial": primitive.Regex{Pattern: "AB.*", Options: "i"}}},
+		{n: "int32", e: "count > 5", r: primitive.M{"count": primitive.M{"$gt": int32(5)}}},
+		{n: "int32-list", e: "count != (1 | 2)", r: primitive.M{"count": primitive.M{"$nin": []any{int32(1), int32(2)}}}},
+		{n: "int64", e: "total == \"42\"", r: primitive.M{"total": int64(42)}},
+		{n: "double", e: "ratio >= 1", r: primitive.M{"ratio": primitive.M{"$gte": 1.0}}},
+		{n: "decimal", e: "price < 19.99", r: primitive.M{"price": primitive.M{"$lt": price}}},
+		{n: "bool", e: "dead == TRUE && other == \"true\"", r: primitive.M{"dead": true, "other": "true"}},
+		{n: "date", e: "lastSeen > \"2020-12-01\"", r: primitive.M{"lastSeen": primitive.M{"$gt": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}}},
+		{n: "objectid", e: "_id == \"5fc4722ae367f19055977d1f\"", r: primitive.M{"_id": oid}},
+		{n: "uuid", e: "uuid == \"123e4567-e89b-12d3-a456-426614174000\"", r: primitive.M{"uuid": primitive.Binary{Subtype: 4, Data: uuid}}},
+		{n: "binary", e: "blob == \"AQID\"", r: primitive.M{"blob": primitive.Binary{Data: []byte{1, 2, 3}}}},
+		{n: "call-args", e: "serial == contains(123)", r: primitive.M{"serial": primitive.Regex{Pattern: ".*123.*", Options: "i"}}},
+		{n: "bad-int32", e: "count == 3000000000", x: "1:10: field count expects a int value"},
+		{n: "bad-bool", e: "dead == maybe", x: "1:9: field dead expects a bool value"},
+		{n: "bad-date", e: "lastSeen < 5", x: "1:12: field lastSeen expects a date value"},
+		{n: "bad-uuid", e: "uuid == \"123e4567\"", x: "1:9: field uuid expects a uuid value"},
+		{n: "bad-objectid", e: "_id == 5fc4722a", x: "1:8: field _id expects a objectId value"},
+	}
+	for _, v := range vectors {
+		rslt, err := p.Parse(v.e)
+		if v.x != "" {
+			s.EqualError(err, v.x, v.n)
+			var pe *ParseError
+			if s.True(errors.As(err, &pe), v.n) {
+				s.Equal(CodeTypeMismatch, pe.Code, v.n)
+			}
+			continue
+		}
+		s.NoError(err, v.n)
+		s.Equal(v.r, rslt, v.n)
+	}
+}
+
+func (s *ReportSuite) TestFieldMapping() {
+	p := NewParser(
+		WithFieldMap(map[string]string{
+			"temp":       "data.temperature_3303.0.value",
+			"customer":   "tags.customer",
+			"lastSeen":   "meta.ts",
+			"meta":       "metadata",
+			"meta.owner": "owner",
+		}),
+		WithFieldResolver(func(field string) (string, error) {
+			if strings.HasPrefix(field, "secret") {
+				return "", fmt.Errorf("field %s is not available", field)
+			}
+			if strings.HasPrefix(field, "attr_") {
+				return "attributes." + strings.TrimPrefix(field, "attr_"), nil
+			}
+			return field, nil
+		}),
+		WithSchema(NewSchema(
+			Field{Path: "temp", Type: TypeDouble},
+			Field{Path: "customer", Type: TypeString},
+			Field{Path: "customer.*", Type: TypeString},
+			Field{Path: "lastSeen", Type: TypeDate},
+			Field{Path: "meta.*"},
+			Field{Path: "attr_color"},
+			Field{Path: "secret"},
+			Field{Path: "name", Type: TypeString},
+		)),
+	)
+
+	vectors := []queryVector{
+		{n: "compare", e: "temp > 20 && customer == ARAMARK", r: primitive.M{"data.temperature_3303.0.value": primitive.M{"$gt": 20.0}, "tags.customer": "ARAMARK"}},
+		{n: "prefix", e: "customer.name == (a | b) && meta.version == 2", r: primitive.M{"tags.customer.name": primitive.M{"$in": []any{"a", "b"}}, "metadata.version": int64(2)}},
+		{n: "longest-prefix", e: "meta.owner.name == bob", r: primitive.M{"owner.name": "bob"}},
+		{n: "exists", e: "exists(temp) && nexists(lastSeen) && customer && !\"meta.x\"", r: primitive.M{"data.temperature_3303.0.value": primitive.M{"$exists": true}, "meta.ts": primitive.M{"$exists": false}, "tags.customer": primitive.M{"$exists": true}, "metadata.x": primitive.M{"$exists": false}}},
+		{n: "resolver", e: "attr_color == red || name == bob", r: primitive.M{"$or": []any{primitive.M{"attributes.color": "red"}, primitive.M{"name": "bob"}}}},
+		{n: "schema-uses-written-name", e: "data.temperature_3303.0.value > 20", x: "1:1: unknown field: data.temperature_3303.0.value"},
+		{n: "resolver-error", e: "name == bob && secret == x", x: "1:16: field secret is not available"},
+	}
+	for _, v := range vectors {
+		rslt, err := p.Parse(v.e)
+		if v.x != "" {
+			s.EqualError(err, v.x, v.n)
+			continue
+		}
+		s.NoError(err, v.n)
+		s.Equal(v.r, rslt, v.n)
+	}
+
+	m, err := p.Matcher("temp > 20")
+	s.Require().NoError(err)
+	matched, err := m.Match(bson.M{"data": bson.M{"temperature_3303": bson.A{bson.M{"value": 25.0}}}})
+	s.NoError(err)
+	s.True(matched)
+}
+
+func (s *ReportSuite) TestFieldComparisons() {
+	expr := func(op string, left string, right string) primitive.M {
+		return primitive.M{op: []any{left, right}}
+	}
+	vectors := []queryVector{
+		{n: "dollar", e: "temp > $threshold", r: primitive.M{"$expr": expr("$gt", "$temp", "$threshold")}},
+		{n: "function", e: "temp <= field(limits.max)", r: primitive.M{"$expr": expr("$lte", "$temp", "$limits.max")}},
+		{n: "quoted", e: "a != field(\"b c\")", r: primitive.M{"$expr": expr("$ne", "$a", "$b c")}},
+		{n: "left-dollar", e: "$temp == $other", r: primitive.M{"$expr": expr("$eq", "$temp", "$other")}},
+		{n: "merged", e: "type == sensor && temp > $threshold", r: primitive.M{"type": "sensor", "$expr": expr("$gt", "$temp", "$threshold")}},
+		{n: "two", e: "a > $b && c < $d", r: primitive.M{"$and": []any{primitive.M{"$expr": expr("$gt", "$a", "$b")}, primitive.M{"$expr": expr("$lt", "$c", "$d")}}}},
+		{n: "literal", e: "a == \"$b\"", r: primitive.M{"a": "$b"}},
+		{n: "in-list", e: "a == (b | field(c))", x: "1:17: field reference c can only be compared with a field"},
+		{n: "condition", e: "field(c) && a == 1", x: "1:7: field reference c can only be compared with a field"},
+	}
+	s.testVectors(vectors)
+
+	p := NewParser(
+		WithSchema(NewSchema(Field{Path: "temp", Type: TypeDouble}, Field{Path: "threshold", Type: TypeInt32}, Field{Path: "name", Type: TypeString})),
+		WithFieldMap(map[string]string{"threshold": "config.threshold"}),
+	)
+	rslt, err := p.Parse("temp > $threshold")
+	s.NoError(err)
+	s.Equal(primitive.M{"$expr": expr("$gt", "$temp", "$config.threshold")}, rslt)
+	_, err = p.Parse("temp > $secret")
+	s.EqualError(err, "1:8: unknown field: secret")
+	_, err = p.Parse("temp == $name")
+	s.EqualError(err, "1:1: cannot compare double field temp with string field name")
+}
+
+func (s *ReportSuite) TestArithmetic() {
+	op := func(name string, args ...any) primitive.M {
+		return primitive.M{name: args}
+	}
+	vectors := []queryVector{
+		{n: "fahrenheit", e: "temp * 1.8 + 32 > 100", r: primitive.M{"$expr": op("$gt", op("$add", op("$multiply", "$temp", 1.8), int64(32)), int64(100))}},
+		{n: "battery", e: "(battery.max - battery.current) / battery.max > 0.8", r: primitive.M{"$expr": op("$gt", op("$divide", op("$subtract", "$battery.max", "$battery.current"), "$battery.max"), 0.8)}},
+		{n: "precedence", e: "a - b - c * d % 2 == 0", r: primitive.M{"$expr": op("$eq", op("$subtract", op("$subtract", "$a", "$b"), op("$mod", op("$multiply", "$c", "$d"), int64(2))), int64(0))}},
+		{n: "unary-minus", e: "-a < $b + $c", r: primitive.M{"$expr": op("$lt", op("$multiply", int64(-1), "$a"), op("$add", "$b", "$c"))}},
+		{n: "right-value", e: "a + b == \"total\"", r: primitive.M{"$expr": op("$eq", op("$add", "$a", "$b"), "total")}},
+		{n: "right-bare-value", e: "a + b == total", x: "1:10: invalid operand for arithmetic: total"},
+		{n: "right-field", e: "a + b == $total", r: primitive.M{"$expr": op("$eq", op("$add", "$a", "$b"), "$total")}},
+		{n: "left-field", e: "total > $a * 2", r: primitive.M{"$expr": op("$gt", "$total", op("$multiply", "$a", int64(2)))}},
+		{n: "quoted-field", e: "\"a b\" * 2 > 1", r: primitive.M{"$expr": op("$gt", op("$multiply", "$a b", int64(2)), int64(1))}},
+		{n: "fold", e: "temp > 9 / 5 * 10 + 2", r: primitive.M{"temp": primitive.M{"$gt": 20.0}}},
+		{n: "fold-int", e: "age >= 6 * (3 + 4) % 5", r: primitive.M{"age": primitive.M{"$gte": int64(2)}}},
+		{n: "fold-negative", e: "temp > -5 && temp < -(2.5)", r: primitive.M{"temp": primitive.M{"$gt": int64(-5), "$lt": -2.5}}},
+		{n: "fold-merged", e: "type == a && temp * 2 > 10 - 2", r: primitive.M{"type": "a", "$expr": op("$gt", op("$multiply", "$temp", int64(2)), int64(8))}},
+		{n: "division-by-zero", e: "temp > 1 / (2 - 2)", x: "1:10: division by zero"},
+		{n: "not-compared", e: "a + b", x: "1:3: unsupported use of: +"},
+		{n: "regex-operand", e: "a + 1 == /x/", x: "1:10: invalid right operand for operator '=='"},
+		{n: "regex-in-arithmetic", e: "a == $b + /x/", x: "1:11: invalid operand for arithmetic"},
+		{n: "right-field-call", e: "a > field(b) * 2", r: primitive.M{"$expr": op("$gt", "$a", op("$multiply", "$b", int64(2)))}},
+		{n: "right-bare-word", e: "name == Alice-Smith", x: "1:9: invalid operand for arithmetic: Alice"},
+		{n: "right-bare-field", e: "total > a * 2", x: "1:9: invalid operand for arithmetic: a"},
+		{n: "right-string", e: "a == \"x\" + \"y\"", x: "1:6: invalid operand for arithmetic"},
+		{n: "unquoted-date", e: "ts == 2020-12-01 || ts == 2020-1-5", r: primitive.M{"$or": []any{primitive.M{"ts": "2020-12-01"}, primitive.M{"ts": "2020-1-5"}}}},
+		{n: "unquoted-date-ordered", e: "ts > 2020-12-01", x: "1:6: invalid right operand for operator '>'"},
+		{n: "unquoted-date-arithmetic", e: "a > 2020-12-01 + 1", x: "1:5: invalid operand for arithmetic: 2020-12-01"},
+		{n: "spaced-subtraction", e: "a > 2020 - 12 - 01", r: primitive.M{"a": primitive.M{"$gt": int64(2007)}}},
+		{n: "divide-field-by-zero", e: "a / 0 > 1", x: "1:3: division by zero"},
+		{n: "mod-field-by-zero", e: "a % 0 == 1", x: "1:3: division by zero"},
+		{n: "divide-by-zero-float", e: "a > b / -0.0", x: "1:7: division by zero"},
+	}
+	s.testVectors(vectors)
+
+	p := NewParser(
+		WithSchema(NewSchema(Field{Path: "temp", Type: TypeDouble}, Field{Path: "offset", Type: TypeInt32}, Field{Path: "name", Type: TypeString})),
+		WithFieldMap(map[string]string{"offset": "config.offset"}),
+	)
+	rslt, err := p.Parse("temp + offset > 10")
+	s.NoError(err)
+	s.Equal(primitive.M{"$expr": op("$gt", op("$add", "$temp", "$config.offset"), int64(10))}, rslt)
+	rslt, err = p.Parse("temp > 5 * 2")
+	s.NoError(err)
+	s.Equal(primitive.M{"temp": primitive.M{"$gt": 10.0}}, rslt)
+	_, err = p.Parse("temp + name > 10")
+	s.EqualError(err, "1:8: field name is a string field and cannot be used in arithmetic")
+	_, err = p.Parse("temp + secret > 10")
+	s.EqualError(err, "1:8: unknown field: secret")
+
+	// unquoted dates are read as dates by date fields
+	p = NewParser(WithSchema(NewSchema(Field{Path: "lastSeen", Type: TypeDate})))
+	rslt, err = p.Parse("lastSeen > 2020-12-01")
+	s.NoError(err)
+	s.Equal(primitive.M{"lastSeen": primitive.M{"$gt": time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}}, rslt)
+}
+
+func (s *ReportSuite) TestSignedNumbers() {
+	vectors := []queryVector{
+		{n: "negative-int", e: "offset > -5", r: primitive.M{"offset": primitive.M{"$gt": int64(-5)}}},
+		{n: "negative-float", e: "lat < -33.8 && lon >= +151.2", r: primitive.M{"lat": primitive.M{"$lt": -33.8}, "lon": primitive.M{"$gte": 151.2}}},
+		{n: "equal", e: "temp == -0.5", r: primitive.M{"temp": -0.5}},
+		{n: "spaced", e: "temp == - 2", r: primitive.M{"temp": int64(-2)}},
+		{n: "in-list", e: "offset == (-1 | +2 | -3.5)", r: primitive.M{"offset": primitive.M{"$in": []any{int64(-1), int64(2), -3.5}}}},
+		{n: "nin-list", e: "offset != (-1 | 0)", r: primitive.M{"offset": primitive.M{"$nin": []any{int64(-1), int64(0)}}}},
+		{n: "subtract-negative", e: "offset - -5 > 0", r: primitive.M{"$expr": primitive.M{"$gt": []any{primitive.M{"$subtract": []any{"$offset", int64(-5)}}, int64(0)}}}},
+		{n: "negated-field", e: "-offset > 5", r: primitive.M{"$expr": primitive.M{"$gt": []any{primitive.M{"$multiply": []any{int64(-1), "$offset"}}, int64(5)}}}},
+		{n: "negated-list-field", e: "offset == (-a | 2)", x: "1:12: unsupported unary operator: '-'"},
+	}
+	s.testVectors(vectors)
+
+	p := NewParser(WithFunctions(Function{Name: "scale", Args: []ArgSpec{{Name: "factor", Type: ArgNumber}, {Name: "offset", Type: ArgInt}}, Call: func(call *Call) (any, error) {
+		return call.Args[0].(float64) * float64(call.Args[1].(int64)), nil
+	}}))
+	rslt, err := p.Parse("temp > scale(-1.5, +2)")
+	s.NoError(err)
+	s.Equal(primitive.M{"temp": primitive.M{"$gt": -3.0}}, rslt)
+
+	before := time.Now().UTC().Add(-15 * time.Minute)
+	rslt, err = ParseQuery("lastSeen > dateRelative(-15m) && lastSeen < dateRelative(+1h)")
+	s.Require().NoError(err)
+	from := rslt["lastSeen"].(primitive.M)["$gt"].(time.Time)
+	s.WithinDuration(before, from, time.Minute)
+
+	schema := NewParser(WithSchema(NewSchema(Field{Path: "offset", Type: TypeInt32}, Field{Path: "code", Type: TypeString})))
+	rslt, err = schema.Parse("offset > -5 && code == -12")
+	s.NoError(err)
+	s.Equal(primitive.M{"offset": primitive.M{"$gt": int32(-5)}, "code": "-12"}, rslt)
+}
+
+func (s *ReportSuite) TestDates() {
+	// a Sunday, half past one in Berlin on the night the clocks go forward
+	now := time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC)
+	p := NewParser(WithClock(func() time.Time { return now }))
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	vectors := []struct {
+		e string
+		r time.Time
+		x string
+	}{
+		{e: "now()", r: now},
+		{e: "today()", r: at(2024, 3, 31, 0, 0)},
+		{e: "today(\"America/New_York\")", r: at(2024, 3, 30, 4, 0)},
+		{e: "startOf(day, \"Europe/Berlin\")", r: at(2024, 3, 30, 23, 0)},
+		{e: "endOf(day, \"Europe/Berlin\")", r: at(2024, 3, 31, 22, 0).Add(-time.Millisecond)},
+		{e: "startOf(week)", r: at(2024, 3, 25, 0, 0)},
+		{e: "startOf(week, \"Europe/Berlin\")", r: at(2024, 3, 24, 23, 0)},
+		{e: "endOf(\"week\")", r: at(2024, 4, 1, 0, 0).Add(-time.Millisecond)},
+		{e: "startOf(month)", r: at(2024, 3, 1, 0, 0)},
+		{e: "endOf(month)", r: at(2024, 4, 1, 0, 0).Add(-time.Millisecond)},
+		{e: "startOf(year)", r: at(2024, 1, 1, 0, 0)},
+		{e: "dateRelative(-7d)", r: at(2024, 3, 24, 0, 30)},
+		{e: "dateRelative(-2w)", r: at(2024, 3, 17, 0, 30)},
+		{e: "dateRelative(1mo)", r: at(2024, 5, 1, 0, 30)},
+		{e: "dateRelative(-1y2d3h)", r: at(2023, 3, 28, 21, 30)},
+		{e: "dateRelative(-1d, \"Europe/Berlin\")", r: at(2024, 3, 30, 0, 30)},
+		{e: "dateRelative(1d, \"Europe/Berlin\")", r: at(2024, 3, 31, 23, 30)},
+		{e: "dateRelative(-P1D)", r: at(2024, 3, 30, 0, 30)},
+		{e: "dateRelative(PT1H30M)", r: at(2024, 3, 31, 2, 0)},
+		{e: "dateRelative(\"-P1Y2M3W4DT5H6M7.5S\")", r: time.Date(2023, 1, 5, 19, 23, 52, 500000000, time.UTC)},
+		{e: "epoch(1700000000)", r: time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{e: "epoch(1700000000123)", r: time.Date(2023, 11, 14, 22, 13, 20, 123000000, time.UTC)},
+		{e: "epoch(-1.5)", r: time.Date(1969, 12, 31, 23, 59, 58, 500000000, time.UTC)},
+		{e: "date(\"2024-03-01 10:00\", \"2006-01-02 15:04\", \"Asia/Tokyo\")", r: at(2024, 3, 1, 1, 0)},
+		{e: "dateRelative(7x)", x: "1:19: dateRelative() invalid duration \"7x\""},
+		{e: "dateRelative(\"-1.5d\")", x: "1:19: dateRelative() invalid duration \"-1.5d\""},
+		{e: "dateRelative(\"P\")", x: "1:19: dateRelative() invalid duration \"P\""},
+		{e: "startOf(hour)", x: "1:14: startOf() unknown unit: hour"},
+		{e: "today(\"Mars/Olympus\")", x: "1:12: today() unknown time zone: Mars/Olympus"},
+		{e: "today(\"Local\")", x: "1:12: today() unknown time zone: Local"},
+		{e: "epoch(now)", x: "1:12: epoch() value must be of type number"},
+	}
+	for _, vector := range vectors {
+		rslt, err := p.Parse("ts > " + vector.e)
+		if vector.x != "" {
+			if s.Error(err, vector.e) {
+				s.Equal(vector.x, err.Error(), vector.e)
+			}
+			continue
+		}
+		if s.NoError(err, vector.e) {
+			s.True(vector.r.Equal(rslt["ts"].(primitive.M)["$gt"].(time.Time)), "%s: %v", vector.e, rslt)
+		}
+	}
+
+	q, err := p.Compile("ts >= startOf(day) && ts <= endOf(day)")
+	s.NoError(err)
+	s.True(q.Volatile())
+	rslt, err := q.RenderAt(at(2024, 4, 2, 12, 0))
+	s.NoError(err)
+	s.Equal(primitive.M{"ts": primitive.M{"$gte": at(2024, 4, 2, 0, 0), "$lte": at(2024, 4, 3, 0, 0).Add(-time.Millisecond)}}, rslt)
+	q, err = p.Compile("ts > epoch(1700000000)")
+	s.NoError(err)
+	s.False(q.Volatile())
+}
+
+func (s *ReportSuite) TestRanges() {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	vectors := []queryVector{
+		{n: "range", e: "age in 18..65", r: primitive.M{"age": primitive.M{"$gte": int64(18), "$lt": int64(65)}}},
+		{n: "range-signed", e: "temp IN -10.5..+10", r: primitive.M{"temp": primitive.M{"$gte": -10.5, "$lt": int64(10)}}},
+		{n: "range-dates", e: "ts in date(\"2024-01-01T00:00:00Z\")..date(\"2024-02-01T00:00:00Z\") && ok", r: primitive.M{"ts": primitive.M{"$gte": from, "$lt": to}, "ok": primitive.M{"$exists": true}}},
+		{n: "range-strings", e: "name in a..\"m\"", x: "1:9: invalid range bound"},
+		{n: "between", e: "between(ts, date(\"2024-01-01T00:00:00Z\"), date(\"2024-02-01T00:00:00Z\"))", r: primitive.M{"ts": primitive.M{"$gte": from, "$lt": to}}},
+		{n: "between-or", e: "between(age, 1, 5) || between(age, 10, 20)", r: primitive.M{"$or": []any{primitive.M{"age": primitive.M{"$gte": int64(1), "$lt": int64(5)}}, primitive.M{"age": primitive.M{"$gte": int64(10), "$lt": int64(20)}}}}},
+		{n: "merge", e: "age >= 18 && age < 65 && age != 30", r: primitive.M{"age": primitive.M{"$gte": int64(18), "$lt": int64(65), "$ne": int64(30)}}},
+		{n: "merge-functions", e: "exists(age) && age > 1 && size(tags) == 2 && tags all [a]", r: primitive.M{"age": primitive.M{"$exists": true, "$gt": int64(1)}, "tags": primitive.M{"$size": int64(2), "$all": []any{"a"}}}},
+		{n: "merge-conflict", e: "age in 1..5 && age < 3", r: primitive.M{"$and": []any{primitive.M{"age": primitive.M{"$gte": int64(1), "$lt": int64(5)}}, primitive.M{"age": primitive.M{"$lt": int64(3)}}}}},
+		{n: "merge-expr", e: "a + 1 > 2 && a + 1 < 5", r: primitive.M{"$and": []any{primitive.M{"$expr": primitive.M{"$gt": []any{primitive.M{"$add": []any{"$a", int64(1)}}, int64(2)}}}, primitive.M{"$expr": primitive.M{"$lt": []any{primitive.M{"$add": []any{"$a", int64(1)}}, int64(5)}}}}}},
+		{n: "range-open", e: "age in 1..", x: "1:11: expected operand, found EOF"},
+		{n: "range-list", e: "age in [1]..5", x: "1:11: expected 'EOF', found '..'"},
+		{n: "range-not-in", e: "age not in 1..5", x: "1:12: expected '[' after not in, found 1"},
+		{n: "range-regex", e: "name in /a/..b", x: "1:9: invalid range bound"},
+		{n: "range-field", e: "age in 1..$max", x: "1:11: field reference max can only be compared with a field"},
+		{n: "between-args", e: "between(age, 1)", x: "1:1: between() expected 3 arguments, got 2"},
+		{n: "between-list", e: "between(age, 1, contains(x))", x: "1:17: invalid range bound"},
+		{n: "range-empty", e: "a in 5..1", x: "1:9: empty range"},
+		{n: "range-equal", e: "a in 1..1.0", x: "1:9: empty range"},
+		{n: "between-empty", e: "between(a, 5, 1)", x: "1:15: empty range"},
+		{n: "range-types", e: "ts in 1..date(\"2024-01-01T00:00:00Z\")", x: "1:10: range bounds have different types"},
+		{n: "between-types", e: "between(ts, date(\"2024-01-01T00:00:00Z\"), 5)", x: "1:43: range bounds have different types"},
+	}
+	s.testVectors(vectors)
+
+	rslt, err := ParseQueryWithParams("ts in ?..:to", from, Named("to", to))
+	s.NoError(err)
+	s.Equal(primitive.M{"ts": primitive.M{"$gte": from, "$lt": to}}, rslt)
+
+	p := NewParser(WithSchema(NewSchema(Field{Path: "age", Type: TypeInt32, Operators: []string{"$gte", "$lt"}}, Field{Path: "name", Type: TypeString, Operators: []string{"$eq"}}, Field{Path: "code", Type: TypeString})))
+	rslt, err = p.Parse("age in 18..65 && code in 1..\"2\"")
+	s.NoError(err)
+	s.Equal(primitive.M{"age": primitive.M{"$gte": int32(18), "$lt": int32(65)}, "code": primitive.M{"$gte": "1", "$lt": "2"}}, rslt)
+	_, err = p.Parse("name in a..b")
+	s.EqualError(err, "1:1: operator $gte is not allowed on field name")
+	_, err = p.Parse("between(age, 18, x)")
+	s.EqualError(err, "1:18: field age expects a int value")
+	_, err = p.Parse("code in \"b\"..\"a\"")
+	s.EqualError(err, "1:14: empty range")
+
+	// between() converts its bounds like in low..high
+	p = NewParser(WithSchema(NewSchema(Field{Path: "age", Type: TypeInt32}, Field{Path: "lastSeen", Type: TypeDate})))
+	for _, e := range []string{"lastSeen in \"2020-01-01\"..\"2020-02-01\" && age in 18..65", "between(lastSeen, \"2020-01-01\", \"2020-02-01\") && between(age, 18, 65)"} {
+		rslt, err = p.Parse(e)
+		s.NoError(err, e)
+		s.Equal(primitive.M{
+			"lastSeen": primitive.M{"$gte": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "$lt": time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+			"age":      primitive.M{"$gte": int32(18), "$lt": int32(65)},
+		}, rslt, e)
+	}
+	_, err = p.Parse("between(lastSeen, \"2020-02-01\", \"2020-01-01\")")
+	s.EqualError(err, "1:33: empty range")
+}
+
+func (s *ReportSuite) TestListSyntax() {
+	oid, _ := primitive.ObjectIDFromHex("5fc4722ae367f19055977d1f")
+	vectors := []queryVector{
+		{n: "in", e: "name in [Alice, \"Bob\", 'Charlie']", r: primitive.M{"name": primitive.M{"$in": []any{"Alice", "Bob", "Charlie"}}}},
+		{n: "not-in", e: "name not in [Alice, Bob]", r: primitive.M{"name": primitive.M{"$nin": []any{"Alice", "Bob"}}}},
+		{n: "all", e: "tags all [a, b]", r: primitive.M{"tags": primitive.M{"$all": []any{"a", "b"}}}},
+		{n: "any", e: "tags any [a, b]", r: primitive.M{"tags": primitive.M{"$in": []any{"a", "b"}}}},
+		{n: "upper", e: "name IN [a] AND tags NOT IN [b] && x ANY [c]", r: primitive.M{"name": primitive.M{"$in": []any{"a"}}, "tags": primitive.M{"$nin": []any{"b"}}, "x": primitive.M{"$in": []any{"c"}}}},
+		{n: "mixed", e: "v in [1, -2.5, true, \"x\", 5fc4722ae367f19055977d1f, /^a/]", r: primitive.M{"v": primitive.M{"$in": []any{int64(1), -2.5, true, "x", oid, primitive.Regex{Pattern: "^a"}}}}},
+		{n: "functions", e: "ts in [date(\"2020-12-01T00:00:00Z\")] && name in [startsWith(al)]", r: primitive.M{"ts": primitive.M{"$in": []any{time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)}}, "name": primitive.M{"$in": []any{primitive.Regex{Pattern: "^al", Options: "i"}}}}},
+		{n: "trailing-comma", e: "n in [1, 2,]", r: primitive.M{"n": primitive.M{"$in": []any{int64(1), int64(2)}}}},
+		{n: "empty-in", e: "name in []", r: primitive.M{"name": primitive.M{"$in": []any{}}}},
+		{n: "empty-not-in", e: "name not in [ ]", r: primitive.M{"name": primitive.M{"$nin": []any{}}}},
+		{n: "empty-all", e: "tags all []", r: primitive.M{"tags": primitive.M{"$all": []any{}}}},
+		{n: "keyword-fields", e: "in in [all] && not == any", r: primitive.M{"in": primitive.M{"$in": []any{"all"}}, "not": "any"}},
+		{n: "quoted-field", e: "\"a b\" in [1]", r: primitive.M{"a b": primitive.M{"$in": []any{int64(1)}}}},
+		{n: "pipe", e: "name == (a | b) || name in [c]", r: primitive.M{"$or": []any{primitive.M{"name": primitive.M{"$in": []any{"a", "b"}}}, primitive.M{"name": primitive.M{"$in": []any{"c"}}}}}},
+		{n: "no-brackets", e: "name in a", x: "1:9: expected '[' after in, found a"},
+		{n: "unterminated", e: "name in [a b]", x: "1:12: expected ']', found b"},
+		{n: "bare-list", e: "name == [a, b]", x: "1:9: list without in, not in, all or any"},
+		{n: "nested", e: "name in [a, (b | c)]", x: "1:13: invalid list value"},
+		{n: "condition", e: "name in [a == b]", x: "1:12: expected ']', found '=='"},
+		{n: "field-ref", e: "name in [$other]", x: "1:10: field reference other can only be compared with a field"},
+		{n: "no-field", e: "in [a]", x: "1:4: expected 'EOF', found '['"},
 	}
 	s.testVectors(vectors)
+
+	p := NewParser(WithSchema(NewSchema(Field{Path: "count", Type: TypeInt32}, Field{Path: "code", Type: TypeString})), WithLimits(Limits{MaxListSize: 2}))
+	rslt, err := p.Parse("count in [1, -2] && code not in [7, x]")
+	s.NoError(err)
+	s.Equal(primitive.M{"count": primitive.M{"$in": []any{int32(1), int32(-2)}}, "code": primitive.M{"$nin": []any{"7", "x"}}}, rslt)
+	_, err = p.Parse("count in [1, x]")
+	s.EqualError(err, "1:14: field count expects a int value")
+	_, err = p.Parse("count in [1, 2, 3]")
+	s.EqualError(err, "1:10: list has more than 2 values")
+	s.ErrorIs(err, ErrLimitExceeded)
+}
+
+func (s *ReportSuite) TestArrayOperators() {
+	size := func(field string) primitive.M {
+		return primitive.M{"$size": primitive.M{"$cond": []any{primitive.M{"$isArray": "$" + field}, "$" + field, []any{}}}}
+	}
+	vectors := []queryVector{
+		{n: "elem-match", e: "elemMatch(readings, type == temp && value > 50)", r: primitive.M{"readings": primitive.M{"$elemMatch": primitive.M{"type": "temp", "value": primitive.M{"$gt": int64(50)}}}}},
+		{n: "elem-match-or", e: "elemMatch(readings, type == temp || !value) && name == a", r: primitive.M{"readings": primitive.M{"$elemMatch": primitive.M{"$or": []any{primitive.M{"type": "temp"}, primitive.M{"value": primitive.M{"$exists": false}}}}}, "name": "a"}},
+		{n: "elem-match-nested", e: "elemMatch(\"a.b\", elemMatch(c, d in [1, 2]))", r: primitive.M{"a.b": primitive.M{"$elemMatch": primitive.M{"c": primitive.M{"$elemMatch": primitive.M{"d": primitive.M{"$in": []any{int64(1), int64(2)}}}}}}}},
+		{n: "elem-match-field-ref", e: "elemMatch(readings, value > $max)", x: "1:21: elemMatch() condition cannot use $expr"},
+		{n: "elem-match-value", e: "elemMatch(readings, 5)", x: "1:21: elemMatch() condition must be of type condition"},
+		{n: "size-eq", e: "size(tags) == 3", r: primitive.M{"tags": primitive.M{"$size": int64(3)}}},
+		{n: "size-ne", e: "size(tags) != 0", r: primitive.M{"tags": primitive.M{"$not": primitive.M{"$size": int64(0)}}}},
+		{n: "size-range", e: "size(tags) > 2 && size(tags) <= 5", r: primitive.M{"$and": []any{primitive.M{"$expr": primitive.M{"$gt": []any{size("tags"), int64(2)}}}, primitive.M{"$expr": primitive.M{"$lte": []any{size("tags"), int64(5)}}}}}},
+		{n: "size-sizes", e: "size(a) < size(b)", r: primitive.M{"$expr": primitive.M{"$lt": []any{size("a"), size("b")}}}},
+		{n: "size-arithmetic", e: "size(a) + 1 >= $count", r: primitive.M{"$expr": primitive.M{"$gte": []any{primitive.M{"$add": []any{size("a"), int64(1)}}, "$count"}}}},
+		{n: "size-string", e: "size(tags) == three", x: "1:15: size() must be compared with a whole number"},
+		{n: "size-negative", e: "size(tags) == -1", x: "1:15: size() must be compared with a whole number"},
+		{n: "size-alone", e: "size(tags) && a == 1", x: "1:1: size() can only be compared with a number"},
+		{n: "size-right", e: "count == size(tags)", x: "1:10: size() can only be compared with a number"},
+		{n: "index", e: "readings[0].value > 50 && matrix[1][2] == 3", r: primitive.M{"readings.0.value": primitive.M{"$gt": int64(50)}, "matrix.1.2": int64(3)}},
+		{n: "index-field-ref", e: "a[0] == $b[1]", r: primitive.M{"$expr": primitive.M{"$eq": []any{"$a.0", "$b.1"}}}},
+		{n: "index-list", e: "readings[0].type in[temp]", r: primitive.M{"readings.0.type": primitive.M{"$in": []any{"temp"}}}},
+		{n: "index-error", e: "readings[0]value == 1", x: "1:12: expected 'EOF', found value"},
+	}
+	s.testVectors(vectors)
+
+	p := NewParser(WithSchema(NewSchema(
+		Field{Path: "readings", Type: TypeObject, Array: true},
+		Field{Path: "readings.type", Type: TypeString},
+		Field{Path: "readings.value", Type: TypeDouble},
+		Field{Path: "name", Type: TypeString},
+	)), WithFieldMap(map[string]string{"readings": "data.readings", "readings.value": "data.readings.v"}))
+	rslt, err := p.Parse("elemMatch(readings, type == 5 && value > 50) && size(readings) == 2")
+	s.NoError(err)
+	s.Equal(primitive.M{"data.readings": primitive.M{"$elemMatch": primitive.M{"type": "5", "v": primitive.M{"$gt": 50.0}}, "$size": int64(2)}}, rslt)
+	_, err = p.Parse("elemMatch(readings, unit == C)")
+	s.EqualError(err, "1:21: unknown field: readings.unit")
+	_, err = p.Parse("elemMatch(readings, value == x)")
+	s.EqualError(err, "1:30: field readings.value expects a double value")
+	_, err = p.Parse("size(name) == 1")
+	s.EqualError(err, "1:6: field name is not an array")
+	_, err = p.Parse("readings == 1")
+	s.EqualError(err, "1:1: field readings is a subdocument and can only be tested for existence")
+}
+
+func (s *ReportSuite) TestNullAndTypes() {
+	vectors := []queryVector{
+		{n: "null", e: "deletedAt == null", r: primitive.M{"deletedAt": nil}},
+		{n: "not-null", e: "owner != NULL && parent != nil", r: primitive.M{"owner": primitive.M{"$ne": nil}, "parent": primitive.M{"$ne": nil}}},
+		{n: "null-list", e: "owner in [null, bob]", r: primitive.M{"owner": primitive.M{"$in": []any{nil, "bob"}}}},
+		{n: "null-string", e: "owner == \"null\"", r: primitive.M{"owner": "null"}},
+		{n: "null-range", e: "age > null", x: "1:7: invalid right operand for operator '>'"},
+		{n: "null-left", e: "null == x", x: "1:1: invalid left operand for operator '=='"},
+		{n: "not-null", e: "!null", x: "1:2: invalid operand for operator '!'"},
+		{n: "not-nil-or", e: "a || !(NIL)", x: "1:7: invalid operand for operator '!'"},
+		{n: "nil-left-in", e: "NIL in [a]", x: "1:1: invalid left operand for operator 'in'"},
+		{n: "is-type", e: "isType(value, \"string\")", r: primitive.M{"value": primitive.M{"$type": "string"}}},
+		{n: "is-types", e: "isType(value, number, date) && isType(tags, array)", r: primitive.M{"value": primitive.M{"$type": []any{"number", "date"}}, "tags": primitive.M{"$type": "array"}}},
+		{n: "is-number", e: "isNumber(temp) || isString(temp)", r: primitive.M{"$or": []any{primitive.M{"temp": primitive.M{"$type": "number"}}, primitive.M{"temp": primitive.M{"$type": "string"}}}}},
+		{n: "is-object-id", e: "!isType(_id, objectId)", r: primitive.M{"$not": primitive.M{"_id": primitive.M{"$type": "objectId"}}}},
+		{n: "unknown-type", e: "isType(value, text)", x: "1:15: unknown type: text"},
+		{n: "no-type", e: "isType(value)", x: "1:1: isType() expected 2 arguments, got 1"},
+	}
+	s.testVectors(vectors)
+
+	p := NewParser(WithSchema(NewSchema(Field{Path: "count", Type: TypeInt32}, Field{Path: "meta", Type: TypeObject})))
+	rslt, err := p.Parse("count == null || isType(meta, object)")
+	s.NoError(err)
+	s.Equal(primitive.M{"$or": []any{primitive.M{"count": nil}, primitive.M{"meta": primitive.M{"$type": "object"}}}}, rslt)
+	_, err = p.Parse("null == count")
+	var pe *ParseError
+	s.Require().ErrorAs(err, &pe)
+	s.Equal(CodeInvalidOperand, pe.Code)
+	s.Equal("1:1: invalid left operand for operator '=='", pe.Error())
+}
+
+func (s *ReportSuite) TestParams() {
+	oid := primitive.NewObjectID()
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	type status string
+	limit := 5
+
+	vectors := []struct {
+		n string
+		e string
+		p []any
+		r primitive.M
+		x string
+	}{
+		{n: "positional", e: "name == ? && age >= ?", p: []any{"Andrew", 5}, r: primitive.M{"name": "Andrew", "age": primitive.M{"$gte": int64(5)}}},
+		{n: "named", e: "deviceId == :deviceId && ts > :since", p: []any{Named("deviceId", oid), Named("since", since)}, r: primitive.M{"deviceId": oid, "ts": primitive.M{"$gt": since}}},
+		{n: "mixed", e: "a == ? && b == :b && c == ?", p: []any{1, Named("b", true), 2.5}, r: primitive.M{"a": int64(1), "b": true, "c": 2.5}},
+		{n: "named-twice", e: "a == :v || b == :v", p: []any{Named("v", "x")}, r: primitive.M{"$or": []any{primitive.M{"a": "x"}, primitive.M{"b": "x"}}}},
+		{n: "literal-string", e: "name == ?", p: []any{"x\" || owner == admin"}, r: primitive.M{"name": "x\" || owner == admin"}},
+		{n: "no-wildcard", e: "name == ? && id == ?", p: []any{"Al*", oid.Hex()}, r: primitive.M{"name": "Al*", "id": oid.Hex()}},
+		{n: "converted", e: "status == ? && limit == ? && ptr == ? && none == ?", p: []any{status("on"), uint8(3), &limit, (*int)(nil)}, r: primitive.M{"status": "on", "limit": int64(3), "ptr": int64(5), "none": nil}},
+		{n: "int32", e: "a == ? && b in ?", p: []any{int32(3), []int32{1}}, r: primitive.M{"a": int64(3), "b": primitive.M{"$in": []any{int64(1)}}}},
+		{n: "in", e: "name in ? && tags all :tags && id not in ?", p: []any{[]string{"a", "b"}, Named("tags", []any{"x", 1}), []primitive.ObjectID{oid}}, r: primitive.M{"name": primitive.M{"$in": []any{"a", "b"}}, "tags": primitive.M{"$all": []any{"x", int64(1)}}, "id": primitive.M{"$nin": []any{oid}}}},
+		{n: "empty-in", e: "name in ?", p: []any{[]string{}}, r: primitive.M{"name": primitive.M{"$in": []any{}}}},
+		{n: "arithmetic", e: "temp * ? > 10", p: []any{2}, r: primitive.M{"$expr": primitive.M{"$gt": []any{primitive.M{"$multiply": []any{"$temp", int64(2)}}, int64(10)}}}},
+		{n: "function", e: "name == contains(?)", p: []any{"a.b"}, r: primitive.M{"name": primitive.Regex{Pattern: ".*a\\.b.*", Options: "i"}}},
+		{n: "missing", e: "a == ? && b == ?", p: []any{1}, x: "1:16: missing value for parameter 2"},
+		{n: "missing-named", e: "a == :id", x: "1:6: missing value for parameter :id"},
+		{n: "extra", e: "a == ?", p: []any{1, 2}, x: "1:1: expected 1 parameters, got 2"},
+		{n: "left", e: "? == 1", p: []any{"a"}, x: "1:1: parameter 1 can only be used as a value"},
+		{n: "alone", e: "a == 1 && :b", p: []any{Named("b", true)}, x: "1:11: parameter :b can only be used as a value"},
+		{n: "list-without-in", e: "a == ?", p: []any{[]int{1}}, x: "1:6: parameter 1 is a list"},
+		{n: "in-without-list", e: "a in ?", p: []any{1}, x: "1:6: parameter 1 is not a list"},
+		{n: "unsupported", e: "a == ?", p: []any{struct{}{}}, x: "1:6: parameter 1: unsupported type struct {}"},
+		{n: "function-field", e: "exists(?)", p: []any{"a"}, x: "1:8: exists() field must be of type field"},
+		{n: "no-name", e: "a == :", x: "1:6: placeholder without a name"},
+	}
+	for _, vector := range vectors {
+		rslt, err := ParseQueryWithParams(vector.e, vector.p...)
+		if vector.x != "" {
+			if s.Error(err, vector.n) {
+				s.Equal(vector.x, err.Error(), vector.n)
+			}
+		} else {
+			s.NoError(err, vector.n)
+			s.Equal(vector.r, rslt, vector.n)
+		}
+	}
+
+	var pe *ParseError
+	_, err := ParseQueryWithParams("a == ?")
+	s.True(errors.As(err, &pe))
+	s.Equal(CodeInvalidParam, pe.Code)
+
+	p := NewParser(WithRegex(false), WithSchema(NewSchema(Field{Path: "age", Type: TypeInt32}, Field{Path: "name", Type: TypeString})))
+	_, err = p.ParseWithParams("name == ?", primitive.Regex{Pattern: "^a"})
+	s.EqualError(err, "1:9: regular expressions are not allowed")
+	_, err = p.ParseWithParams("age == ?", "ten")
+	s.Error(err)
+
+	t, err := Prepare("deviceId == :id && ts >= ?")
+	s.NoError(err)
+	for i := 0; i < 3; i++ {
+		rslt, err := t.Bind(since, Named("id", i))
+		s.NoError(err)
+		s.Equal(primitive.M{"deviceId": int64(i), "ts": primitive.M{"$gte": since}}, rslt)
+	}
+	d, err := t.BindD(Named("id", "a"), since)
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "deviceId", Value: "a"}, {Key: "ts", Value: bson.D{{Key: "$gte", Value: since}}}}, d)
+	_, err = Prepare("a == (?")
+	s.Error(err)
+}
+
+func (s *ReportSuite) TestCompile() {
+	q, err := Compile("name == Andrew && age >= 5")
+	s.NoError(err)
+	s.False(q.Volatile())
+	s.Equal("name == Andrew && age >= 5", q.String())
+	rslt, err := q.Render()
+	s.NoError(err)
+	s.Equal(primitive.M{"name": "Andrew", "age": primitive.M{"$gte": int64(5)}}, rslt)
+	rslt["age"].(primitive.M)["$gte"] = int64(6)
+	d, err := q.RenderD()
+	s.NoError(err)
+	s.Equal(bson.D{{Key: "name", Value: "Andrew"}, {Key: "age", Value: bson.D{{Key: "$gte", Value: int64(5)}}}}, d)
+	_, err = Compile("name == (")
+	s.EqualError(err, "1:10: expected operand, found EOF")
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewParser(WithClock(func() time.Time { return now }))
+	q, err = clock.Compile("lastSeen > dateRelative(-15m) && lastSeen < dateRelative(1h)")
+	s.NoError(err)
+	s.True(q.Volatile())
+	rslt, err = q.Render()
+	s.NoError(err)
+	s.Equal(primitive.M{"lastSeen": primitive.M{"$gt": now.Add(-15 * time.Minute), "$lt": now.Add(time.Hour)}}, rslt)
+	now = now.Add(time.Minute)
+	rslt, err = q.Render()
+	s.NoError(err)
+	s.Equal(now.Add(-15*time.Minute), rslt["lastSeen"].(primitive.M)["$gt"])
+	then := time.Date(2023, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	rslt, err = q.RenderAt(then)
+	s.NoError(err)
+	s.Equal(then.UTC().Add(-15*time.Minute), rslt["lastSeen"].(primitive.M)["$gt"])
+	rslt, err = clock.Parse("lastSeen > dateRelative(-1h)")
+	s.NoError(err)
+	s.Equal(primitive.M{"lastSeen": primitive.M{"$gt": now.Add(-time.Hour)}}, rslt)
+
+	p := NewParser(WithCache(2), WithScope(bson.D{{Key: "tenantId", Value: "t1"}}))
+	a, err := p.Compile("name == Andrew")
+	s.NoError(err)
+	b, err := p.Compile("  name==Andrew ")
+	s.NoError(err)
+	s.Same(a, b)
+	c, err := p.Compile("name == \"Andrew\"")
+	s.NoError(err)
+	s.NotSame(a, c)
+	rslt, err = b.Render()
+	s.NoError(err)
+	s.Equal(primitive.M{"tenantId": "t1", "name": "Andrew"}, rslt)
+	_, err = p.Compile("age > 5")
+	s.NoError(err)
+	s.Equal(2, p.cache.len())
+	b, err = p.Compile("name == Andrew")
+	s.NoError(err)
+	s.NotSame(a, b)
+	rslt, err = p.Parse("age  >  5")
+	s.NoError(err)
+	s.Equal(primitive.M{"tenantId": "t1", "age": primitive.M{"$gt": int64(5)}}, rslt)
+	s.Equal(2, p.cache.len())
+
+	s.NoError(p.RegisterFunction(Function{Name: "online", Call: func(call *Call) (any, error) { return bson.M{"online": true}, nil }}))
+	s.Equal(0, p.cache.len())
+	scoped := p.With(WithScope(bson.D{{Key: "siteId", Value: "s1"}}))
+	rslt, err = scoped.Parse("online()")
+	s.NoError(err)
+	s.Equal(primitive.M{"tenantId": "t1", "siteId": "s1", "online": true}, rslt)
+	s.Equal(0, p.cache.len())
+
+	p = NewParser(WithCache(10), WithLimits(Limits{MaxLength: 16}))
+	_, err = p.Compile("age > 5")
+	s.NoError(err)
+	_, err = p.Compile("age      >      5")
+	s.EqualError(err, "1:17: expression longer than 16 bytes")
+
+	// spellings that parse differently are cached apart
+	p = NewParser(WithCache(10))
+	for _, pair := range [][2]string{
+		{"a > 2020 - 12 - 01", "a > 2020-12-01"},
+		{"ts > dateRelative(-15m)", "ts > dateRelative(- 15m)"},
+	} {
+		_, err = p.Compile(pair[0])
+		s.NoError(err, pair[0])
+		_, uncached := ParseQuery(pair[1])
+		s.Error(uncached, pair[1])
+		_, err = p.Compile(pair[1])
+		s.Equal(uncached, err, pair[1])
+	}
 }
 
 func (s *ReportSuite) TestRegexQueries() {
 
 	vectors := []queryVector{
 		{n: "regex1", e: "name == regex(\".*Alice.*\")", r: primitive.M{"name": primitive.Regex{Pattern: ".*Alice.*", Options: "i"}}},
-		{n: "regex2", e: "name ==/.*Alice.*/", x: "1:8: expected operand, found '/'"},
+		{n: "regex2", e: "name ==/.*Alice.*/", r: primitive.M{"name": primitive.Regex{Pattern: ".*Alice.*"}}},
+		{n: "regex-flags", e: "name == /^al\\/ice$/i", r: primitive.M{"name": primitive.Regex{Pattern: "^al/ice$", Options: "i"}}},
+		{n: "regex-escape", e: "name == regex(\"^\\d+$\")", r: primitive.M{"name": primitive.Regex{Pattern: "^\\d+$", Options: "i"}}},
+		{n: "regex-backslash", e: "name == /a\\\\/", r: primitive.M{"name": primitive.Regex{Pattern: "a\\\\"}}},
+		{n: "regex-backslash-slash", e: "name == /a\\\\\\/b/m", r: primitive.M{"name": primitive.Regex{Pattern: "a\\\\/b", Options: "m"}}},
 		{n: "regex3", e: "name == contains(Alice)", r: primitive.M{"name": primitive.Regex{Pattern: ".*Alice.*", Options: "i"}}},
 		{n: "regex3", e: "name == \"Alice*\"", r: primitive.M{"name": primitive.Regex{Pattern: "Alice.*", Options: "i"}}},
+		{n: "contains-escaped", e: "name == contains(\"a.b(c)\")", r: primitive.M{"name": primitive.Regex{Pattern: ".*a\\.b\\(c\\).*", Options: "i"}}},
+		{n: "starts-with", e: "name == startsWith(\"1+1\")", r: primitive.M{"name": primitive.Regex{Pattern: "^1\\+1", Options: "i"}}},
+		{n: "ends-with", e: "name == endsWith(\".com\")", r: primitive.M{"name": primitive.Regex{Pattern: "\\.com$", Options: "i"}}},
+		{n: "wildcard-escaped", e: "name == \"a.b*[c]\"", r: primitive.M{"name": primitive.Regex{Pattern: "a\\.b.*\\[c\\]", Options: "i"}}},
+		{n: "nested-quantifier", e: "name == /(a+)+$/", x: "1:9: unsafe regex: nested quantifiers"},
+		{n: "nested-repeat", e: "name == regex(\"^(\\w{2,}\\s?)*$\")", x: "1:9: unsafe regex: nested quantifiers"},
+		{n: "nested-string", e: "name == \"/(.*a)*/\"", x: "1:9: unsafe regex: nested quantifiers"},
+		{n: "backreference", e: "name == /(a)\\1/", x: "1:9: invalid regex: invalid escape sequence: `\\1`"},
+		{n: "too-long", e: "name == /" + strings.Repeat("a", 1025) + "/", x: "1:9: regex longer than 1024 bytes"},
 	}
 	s.testVectors(vectors)
+
+	m, err := NewMatcher("name == contains(\"a.b\")")
+	s.Require().NoError(err)
+	matched, err := m.Match(bson.M{"name": "axb"})
+	s.NoError(err)
+	s.False(matched)
 }
 
 func (s *ReportSuite) TestFullTextSearchQueries() {
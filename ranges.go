@@ -0,0 +1,115 @@
+package mongoq
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// convertRange converts the range of in, e.g. 18..65, into the operators of a half-open range: the low bound is
+// included and the high bound is not, as with ts >= low && ts < high.
+func (c *converter) convertRange(e *rangeExpr, parentOp *tokenKind) (any, error) {
+	low, err := c.convertExprToMongoQuery(e.Low, parentOp)
+	if err != nil {
+		return nil, err
+	}
+	high, err := c.convertExprToMongoQuery(e.High, parentOp)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: "$gte", Value: low}, {Key: "$lt", Value: high}}, nil
+}
+
+// checkRangeBound rejects bounds that are not single values, before the field is looked up.
+func checkRangeBound(v any, n node) error {
+	switch tv := v.(type) {
+	case *fieldRef:
+		return tv.misplaced()
+	case *arraySize:
+		return tv.misplaced()
+	case bson.D, []any, primitive.Regex:
+		return nodeError(CodeInvalidOperand, n, "use values such as numbers, strings or dates", "invalid range bound")
+	}
+	return nil
+}
+
+// rangeCondition builds the condition for a range of the field name, checking both operators and bounds against the
+// schema.  fieldNode, lowNode and highNode locate errors.
+func (c *converter) rangeCondition(name string, low any, high any, fieldNode node, lowNode node, highNode node) (bson.D, error) {
+	bounds := bson.D{{Key: "$gte", Value: low}, {Key: "$lt", Value: high}}
+	var path string
+	for i, bound := range bounds {
+		n := lowNode
+		if i > 0 {
+			n = highNode
+		}
+		if err := checkRangeBound(bound.Value, n); err != nil {
+			return nil, err
+		}
+		var f *Field
+		var err error
+		if path, f, err = c.resolveField(name, fieldNode, bound.Key); err != nil {
+			return nil, err
+		}
+		if err := c.checkValue(f, c.elemPath(name), bound.Value, n); err != nil {
+			return nil, err
+		}
+		if !isOrderedValue(f, bound.Value) {
+			return nil, nodeError(CodeInvalidOperand, n, "use a number or a date", "invalid range bound")
+		}
+	}
+	cmp, ok := compareValues(low, high)
+	if !ok {
+		return nil, nodeError(CodeInvalidOperand, highNode, "use bounds of the same type", "range bounds have different types")
+	}
+	if cmp >= 0 {
+		return nil, nodeError(CodeInvalidOperand, highNode, "the high bound is excluded, so it must be greater than the low bound", "empty range")
+	}
+	return bson.D{{Key: path, Value: bounds}}, nil
+}
+
+// coerceBound converts a literal bound of between() against the schema type of the field name, as the bounds of
+// in low..high are.
+func (c *converter) coerceBound(name string, v any, n node) (any, error) {
+	if c.p.schema == nil {
+		return v, nil
+	}
+	switch v.(type) {
+	case string, int64, float64:
+	default:
+		return v, nil // keywords, field references and dates
+	}
+	var raw string
+	var kind tokenKind
+	switch lit := n.(type) {
+	case *basicLit:
+		raw, kind = lit.Value, lit.Kind
+	case *ident:
+		raw, kind = lit.Name, tokIdent
+	default:
+		return v, nil // the results of functions
+	}
+	target, targetName := c.target, c.targetName
+	defer func() { c.target, c.targetName = target, targetName }()
+	c.targetName = c.elemPath(name)
+	c.target, _ = c.p.schema.Lookup(c.targetName)
+	coerced, ok, err := c.coerceLiteral(raw, kind, n)
+	if err != nil || !ok {
+		return v, err
+	}
+	return coerced, nil
+}
+
+// callBetween matches values from low, included, to high, excluded, like in low..high, e.g.
+// between(ts, date("2024-01-01T00:00:00Z"), date("2024-02-01T00:00:00Z")).
+func callBetween(call *Call) (any, error) {
+	name := call.String(0)
+	low, err := call.c.coerceBound(name, call.Args[1], call.e.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	high, err := call.c.coerceBound(name, call.Args[2], call.e.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	return call.c.rangeCondition(name, low, high, call.e.Args[0], call.e.Args[1], call.e.Args[2])
+}
@@ -0,0 +1,63 @@
+package mongoq
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// maxRegexLength bounds the length of a regex pattern written by the user.
+const maxRegexLength = 1024
+
+// validateRegex rejects patterns that could make MongoDB backtrack catastrophically: overly long patterns, nested
+// quantifiers such as (a+)+, and constructs RE2 does not support, such as backreferences and lookarounds.
+func validateRegex(pattern string, options string) error {
+	if len(pattern) > maxRegexLength {
+		return fmt.Errorf("regex longer than %d bytes", maxRegexLength)
+	}
+	flags := syntax.Perl
+	if strings.Contains(options, "i") {
+		flags |= syntax.FoldCase
+	}
+	re, err := syntax.Parse(pattern, flags)
+	if err != nil {
+		return fmt.Errorf("invalid regex: %s", strings.TrimPrefix(err.Error(), "error parsing regexp: "))
+	}
+	if hasNestedRepeat(re, false) {
+		return fmt.Errorf("unsafe regex: nested quantifiers")
+	}
+	return nil
+}
+
+func hasNestedRepeat(re *syntax.Regexp, inRepeat bool) bool {
+	switch re.Op {
+	case syntax.OpStar, syntax.OpPlus:
+		if inRepeat {
+			return true
+		}
+		inRepeat = true
+	case syntax.OpRepeat:
+		if re.Max == -1 || re.Max > 1 {
+			if inRepeat {
+				return true
+			}
+			inRepeat = true
+		}
+	}
+	for _, sub := range re.Sub {
+		if hasNestedRepeat(sub, inRepeat) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardPattern converts a value containing '*' wildcards into a regex pattern, escaping everything else.
+func wildcardPattern(value string) string {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return strings.Join(parts, ".*")
+}
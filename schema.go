@@ -0,0 +1,319 @@
+package mongoq
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FieldType is the BSON type of a field declared in a Schema.
+type FieldType string
+
+const (
+	TypeAny      FieldType = ""
+	TypeString   FieldType = "string"
+	TypeInt32    FieldType = "int"
+	TypeInt64    FieldType = "long"
+	TypeDouble   FieldType = "double"
+	TypeDecimal  FieldType = "decimal"
+	TypeNumber   FieldType = "number" // any numeric type
+	TypeBool     FieldType = "bool"
+	TypeDate     FieldType = "date"
+	TypeObjectID FieldType = "objectId"
+	TypeUUID     FieldType = "uuid"    // binary subtype 4, written as a UUID string
+	TypeBinary   FieldType = "binData" // binary subtype 0, written as a base64 string
+	TypeObject   FieldType = "object"  // a subdocument, only its existence can be tested
+)
+
+// Field declares a field that expressions may reference.
+type Field struct {
+	// Path is the dotted field path.  A "*" segment matches any single segment, and a trailing "*" matches the rest
+	// of the path, so "data.*" permits data.temperature and data.temperature.value.
+	Path string
+	// Type is the BSON type of the field, or of its elements if Array is set.
+	Type  FieldType
+	Array bool
+	// Operators lists the MongoDB operators allowed on the field, e.g. "$eq", "$gt", "$in", "$regex" or "$exists".
+	// Nil allows all of them.
+	Operators []string
+}
+
+// Schema is an allowlist of fields with their types.  A Parser with a schema rejects references to undeclared
+// fields, operators that are not allowed on a field, and values of the wrong type.  Literals compared against a
+// declared field are converted to its type, e.g. 123 to "123" for a string field or to int32 for an int field.
+type Schema struct {
+	exact    map[string]*Field
+	patterns []*Field
+}
+
+// NewSchema creates a schema from fields.
+func NewSchema(fields ...Field) *Schema {
+	s := &Schema{exact: map[string]*Field{}}
+	for i := range fields {
+		f := fields[i]
+		if strings.Contains(f.Path, "*") {
+			s.patterns = append(s.patterns, &f)
+		} else {
+			s.exact[f.Path] = &f
+		}
+	}
+	return s
+}
+
+// WithSchema restricts the fields, operators and values a parser accepts.
+func WithSchema(schema *Schema) Option {
+	return func(p *Parser) {
+		p.schema = schema
+	}
+}
+
+// Lookup returns the declaration matching path.
+func (s *Schema) Lookup(path string) (*Field, bool) {
+	if f, found := s.exact[path]; found {
+		return f, true
+	}
+	for _, f := range s.patterns {
+		if matchFieldPattern(f.Path, path) {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func matchFieldPattern(pattern string, path string) bool {
+	pp := strings.Split(pattern, ".")
+	ps := strings.Split(path, ".")
+	for i, seg := range pp {
+		if i >= len(ps) {
+			return false
+		}
+		if seg == "*" {
+			if i == len(pp)-1 {
+				return true
+			}
+			continue
+		}
+		if seg != ps[i] {
+			return false
+		}
+	}
+	return len(pp) == len(ps)
+}
+
+func (f *Field) allows(op string) bool {
+	if f.Operators == nil {
+		return true
+	}
+	for _, allowed := range f.Operators {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether value can be stored in a field of this type.
+func (f *Field) accepts(value any) bool {
+	switch value.(type) {
+	case nil:
+		return true
+	case primitive.Regex:
+		return f.Type == TypeAny || f.Type == TypeString
+	}
+	switch f.Type {
+	case TypeAny:
+		return true
+	case TypeString:
+		_, ok := value.(string)
+		return ok
+	case TypeInt32, TypeInt64:
+		switch value.(type) {
+		case int32, int64:
+			return true
+		}
+		return false
+	case TypeDecimal:
+		if _, ok := value.(primitive.Decimal128); ok {
+			return true
+		}
+		_, ok := toFloat(value)
+		return ok
+	case TypeDouble, TypeNumber:
+		_, ok := toFloat(value)
+		return ok
+	case TypeBool:
+		_, ok := value.(bool)
+		return ok
+	case TypeDate:
+		_, ok := value.(time.Time)
+		return ok
+	case TypeObjectID:
+		_, ok := value.(primitive.ObjectID)
+		return ok
+	case TypeUUID, TypeBinary:
+		_, ok := value.(primitive.Binary)
+		return ok
+	}
+	return false
+}
+
+// coerce converts the text of a literal to the field's type.  It returns false if the literal should be converted
+// as usual, e.g. a wildcard compared against a string field or any literal for an untyped field.
+func (f *Field) coerce(raw string, kind tokenKind) (any, bool, error) {
+	switch f.Type {
+	case TypeString:
+		if kind == tokString {
+			if _, isRe := isRegex(raw); isRe || strings.Contains(raw, "*") {
+				return nil, false, nil
+			}
+		}
+		return raw, true, nil
+	case TypeInt32:
+		i, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return nil, true, err
+		}
+		return int32(i), true, nil
+	case TypeInt64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, true, err
+		}
+		return i, true, nil
+	case TypeDouble:
+		fv, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, true, err
+		}
+		return fv, true, nil
+	case TypeDecimal:
+		d, err := primitive.ParseDecimal128(raw)
+		if err != nil {
+			return nil, true, err
+		}
+		return d, true, nil
+	case TypeBool:
+		b, err := strconv.ParseBool(strings.ToLower(raw))
+		if err != nil {
+			return nil, true, err
+		}
+		return b, true, nil
+	case TypeDate:
+		if kind != tokString && kind != tokIdent {
+			return nil, true, fmt.Errorf("not a date")
+		}
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+			if ts, err := time.Parse(layout, raw); err == nil {
+				return ts, true, nil
+			}
+		}
+		return nil, true, fmt.Errorf("not a date")
+	case TypeObjectID:
+		oid, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return nil, true, err
+		}
+		return oid, true, nil
+	case TypeUUID:
+		data, err := parseUUID(raw)
+		if err != nil {
+			return nil, true, err
+		}
+		return primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: data}, true, nil
+	case TypeBinary:
+		data, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, true, err
+		}
+		return primitive.Binary{Subtype: bson.TypeBinaryGeneric, Data: data}, true, nil
+	}
+	return nil, false, nil
+}
+
+func parseUUID(s string) ([]byte, error) {
+	h := strings.ReplaceAll(s, "-", "")
+	if len(h) != 32 || (len(s) != 32 && len(s) != 36) {
+		return nil, fmt.Errorf("not a UUID")
+	}
+	return hex.DecodeString(h)
+}
+
+// coerceLiteral converts a literal on the right side of a comparison against a declared field.
+func (c *converter) coerceLiteral(raw string, kind tokenKind, n node) (any, bool, error) {
+	if c.target == nil {
+		return nil, false, nil
+	}
+	v, ok, err := c.target.coerce(raw, kind)
+	if err != nil {
+		return nil, true, nodeError(CodeTypeMismatch, n, "", "field %s expects a %s value", c.targetName, c.target.Type)
+	}
+	return v, ok, nil
+}
+
+// checkField validates a reference to field with the given operator, returning its declaration if there is a
+// schema.
+func (c *converter) checkField(field string, n node, op string) (*Field, error) {
+	if c.p.schema == nil {
+		return nil, nil
+	}
+	f, found := c.p.schema.Lookup(field)
+	if !found {
+		return nil, nodeError(CodeUnknownField, n, "", "unknown field: %s", field)
+	}
+	if !f.allows(op) {
+		return nil, nodeError(CodeOperatorNotAllowed, n, "allowed operators are "+strings.Join(f.Operators, ", "), "operator %s is not allowed on field %s", op, field)
+	}
+	arrayOp := op == "$elemMatch" || op == "$size"
+	if arrayOp && !f.Array {
+		return nil, nodeError(CodeTypeMismatch, n, "", "field %s is not an array", field)
+	}
+	if f.Type == TypeObject && op != "$exists" && op != "$type" && !arrayOp {
+		return nil, nodeError(CodeTypeMismatch, n, "", "field %s is a subdocument and can only be tested for existence", field)
+	}
+	return f, nil
+}
+
+// checkValue validates a value compared against a declared field; lists are checked element by element.
+func (c *converter) checkValue(f *Field, field string, value any, n node) error {
+	if f == nil {
+		return nil
+	}
+	if list, ok := value.([]any); ok {
+		for _, item := range list {
+			if err := c.checkValue(f, field, item, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !f.accepts(value) {
+		return nodeError(CodeTypeMismatch, n, "", "field %s expects a %s value", field, f.Type)
+	}
+	return nil
+}
+
+// comparisonOperator returns the MongoDB operator a comparison produces for the converted right side, e.g. $in for
+// a list or $regex for a pattern, and the value or values being compared.
+func comparisonOperator(operator string, right any) (string, any) {
+	if rd, ok := right.(bson.D); ok && len(rd) == 1 {
+		switch rd[0].Key {
+		case "$in":
+			if operator == "$ne" {
+				return "$nin", rd[0].Value
+			}
+			return "$in", rd[0].Value
+		case "$all":
+			return "$all", rd[0].Value
+		}
+	}
+	if _, ok := right.(primitive.Regex); ok && operator == "$eq" {
+		return "$regex", right
+	}
+	return operator, right
+}
@@ -0,0 +1,183 @@
+package mongoq
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeAliases are the BSON type names $type accepts, with "number" matching any numeric type.
+var typeAliases = []string{"double", "string", "object", "array", "binData", "undefined", "objectId", "bool", "date",
+	"null", "regex", "dbPointer", "javascript", "symbol", "int", "timestamp", "long", "decimal", "minKey", "maxKey",
+	"number"}
+
+func isTypeAlias(name string) bool {
+	for _, alias := range typeAliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// callIsType matches fields of one of the given BSON types, e.g. isType(value, "number", "string").
+func callIsType(call *Call) (any, error) {
+	types := make([]any, 0, len(call.Args)-1)
+	for i, t := range call.Strings(1) {
+		if !isTypeAlias(t) {
+			return nil, call.ArgError(i+1, "types are "+strings.Join(typeAliases, ", "), "unknown type: %s", t)
+		}
+		types = append(types, t)
+	}
+	if len(types) == 1 {
+		return typeCondition(call, types[0])
+	}
+	return typeCondition(call, types)
+}
+
+func callIsNumber(call *Call) (any, error) {
+	return typeCondition(call, "number")
+}
+
+func callIsString(call *Call) (any, error) {
+	return typeCondition(call, "string")
+}
+
+func typeCondition(call *Call, types any) (any, error) {
+	path, err := call.Field(0, "$type")
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Key: path, Value: bson.D{{Key: "$type", Value: types}}}}, nil
+}
+
+// typeNames returns the argument of $type as a list of type names.
+func typeNames(arg any) ([]string, error) {
+	if name, ok := arg.(string); ok {
+		return []string{name}, nil
+	}
+	list, ok := asArray(arg)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("$type needs a type name or a non-empty array of them")
+	}
+	names := make([]string, 0, len(list))
+	for _, item := range list {
+		name, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("$type needs a type name or a non-empty array of them")
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// matchType matches values of one of the types; an array matches "array" itself, and any other type through its
+// elements.
+func matchType(values []any, arg any) (bool, error) {
+	names, err := typeNames(arg)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name == "array" {
+			for _, v := range values {
+				if _, isArr := asArray(v); isArr {
+					return true, nil
+				}
+			}
+			continue
+		}
+		for _, v := range candidates(values) {
+			if _, isArr := asArray(v); isArr {
+				continue
+			}
+			if t := typeOf(v); t == name || (name == "number" && isNumericType(FieldType(t))) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// typeOf returns the BSON type name of a decoded value.
+func typeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int32:
+		return "int"
+	case int, int64:
+		return "long"
+	case float32, float64:
+		return "double"
+	case primitive.Decimal128:
+		return "decimal"
+	case time.Time, primitive.DateTime:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case primitive.Binary:
+		return "binData"
+	case primitive.Regex:
+		return "regex"
+	case primitive.Timestamp:
+		return "timestamp"
+	case primitive.JavaScript:
+		return "javascript"
+	case primitive.Symbol:
+		return "symbol"
+	case primitive.Undefined:
+		return "undefined"
+	case primitive.DBPointer:
+		return "dbPointer"
+	case primitive.MinKey:
+		return "minKey"
+	case primitive.MaxKey:
+		return "maxKey"
+	case bson.M, bson.D, map[string]any:
+		return "object"
+	}
+	return ""
+}
+
+// aggType tests the type of ref in an aggregation expression, where $type returns the name of the value's own type.
+func aggType(ref string, arg any) (bson.D, error) {
+	names, err := typeNames(arg)
+	if err != nil {
+		return nil, err
+	}
+	terms := make([]any, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "number":
+			terms = append(terms, bson.D{{Key: "$isNumber", Value: ref}})
+		case "array":
+			terms = append(terms, bson.D{{Key: "$isArray", Value: ref}})
+		default:
+			terms = append(terms, bson.D{{Key: "$eq", Value: []any{bson.D{{Key: "$type", Value: ref}}, name}}})
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0].(bson.D), nil
+	}
+	return bson.D{{Key: "$or", Value: terms}}, nil
+}
+
+func formatTypes(arg any) (string, error) {
+	names, err := typeNames(arg)
+	if err != nil {
+		return "", err
+	}
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteString(name))
+	}
+	return strings.Join(quoted, ", "), nil
+}